@@ -0,0 +1,80 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"context"
+	"sync"
+)
+
+// supervisor owns the goroutines a cache runs in the background, so that
+// they can be counted and all stopped together.
+type supervisor struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped bool
+	running int
+	wg      sync.WaitGroup
+}
+
+// spawn runs f in a new goroutine and reports whether it did. f must
+// return once ctx is done, which happens on stop. It does nothing after
+// stop.
+func (s *supervisor) spawn(f func(ctx context.Context)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	s.running++
+	s.wg.Add(1)
+	go func(ctx context.Context) {
+		defer func() {
+			s.mu.Lock()
+			s.running--
+			s.mu.Unlock()
+			s.wg.Done()
+		}()
+		f(ctx)
+	}(s.ctx)
+	return true
+}
+
+// stop signals every goroutine to exit and waits for them. It is safe to
+// call more than once.
+func (s *supervisor) stop() {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		if s.cancel != nil {
+			s.cancel()
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *supervisor) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
@@ -19,8 +19,15 @@ package cache2
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +36,63 @@ type Flusher interface {
 	Remove(key string)
 }
 
+// FlusherWithError is a Flusher whose writes to the backing store can
+// fail. Entries whose write failed stay dirty and are retried by the next
+// flush.
+type FlusherWithError interface {
+	Add(key string, value interface{}) error
+	Remove(key string) error
+}
+
+// flusherAdapter lets a Flusher be used where a FlusherWithError is
+// expected. Its writes never fail.
+type flusherAdapter struct {
+	flusher Flusher
+}
+
+func (f *flusherAdapter) Add(key string, value interface{}) error {
+	f.flusher.Add(key, value)
+	return nil
+}
+
+func (f *flusherAdapter) Remove(key string) error {
+	f.flusher.Remove(key)
+	return nil
+}
+
+// FlusherWithContext is implemented by flushers whose writes can be
+// cancelled. FlushContext and the periodic flush pass their context to
+// these methods instead of calling Add and Remove.
+type FlusherWithContext interface {
+	AddContext(ctx context.Context, key string, value interface{}) error
+	RemoveContext(ctx context.Context, key string) error
+}
+
+// FailedEntry is a key whose pending modification could not be flushed.
+type FailedEntry struct {
+	Key string
+	Err error
+}
+
+// FlushResult reports how many dirty elements a flush wrote to the
+// backing store, and which keys it could not write. A key appears in
+// Failed at most once, with the first error seen for it; later
+// modifications of a failed key are left dirty without being attempted so
+// that they are replayed in order.
+type FlushResult struct {
+	Succeeded int
+	Failed    []FailedEntry
+}
+
+// err joins the errors of the failed writes, or returns nil.
+func (r FlushResult) err() error {
+	errs := make([]error, len(r.Failed))
+	for i, f := range r.Failed {
+		errs[i] = f.Err
+	}
+	return errors.Join(errs...)
+}
+
 type dirtyElement struct {
 	modified bool
 	removed  bool
@@ -37,8 +101,74 @@ type dirtyElement struct {
 }
 
 type cacheItem struct {
-	key   string
-	value interface{}
+	// hits and accessed are updated atomically by read-locked Gets, so
+	// they come first to be 64-bit aligned on 32-bit platforms. accessed
+	// is the sequence number of the latest such Get, or 0. lastAccess is
+	// the time in Unix nanoseconds of the latest Get of any kind.
+	hits       uint64
+	accessed   uint64
+	lastAccess int64
+
+	key     string
+	value   interface{}
+	dirty   bool
+	seq     uint64
+	cleanup func(value interface{})
+	created time.Time
+	// size is the entry's size as measured by the cache's sizer.
+	size int
+	// epoch is the aging interval hits was last aged in.
+	epoch uint64
+	// expires is when the entry stops being valid. It is zero for entries
+	// that never expire. ttl is the lifetime it was set with, renewed by
+	// Touch.
+	expires time.Time
+	ttl     time.Duration
+	// expiryIndex is the item's index in the cache's expiry heap plus
+	// one, or 0 if it is not in it.
+	expiryIndex int
+}
+
+// KeyMeta describes a cached entry without its value.
+type KeyMeta struct {
+	Key string
+	// Age is the time since the entry was inserted.
+	Age time.Duration
+	// AccessCount is the number of Get calls that found the entry. It
+	// decays over time if SetAccessCountAging is used.
+	AccessCount uint64
+	// Dirty tells whether the entry has modifications that are not
+	// flushed yet. It is always false in a SimpleCache.
+	Dirty bool
+}
+
+// Item is a cached entry along with what the cache knows about it.
+type Item struct {
+	Entry
+	// Created is when the entry was inserted.
+	Created time.Time
+	// LastAccess is when a Get last found the entry, or Created if none
+	// did yet.
+	LastAccess time.Time
+	// Expires is when the entry expires, or zero if it never does.
+	Expires time.Time
+	// Hits is the number of Get calls that found the entry, aged like
+	// KeyMeta.AccessCount.
+	Hits uint64
+}
+
+// Entry is a key and the value cached under it.
+type Entry struct {
+	Key   string
+	Value interface{}
+}
+
+// OverflowStore keeps dirty entries that a Cache evicted before they were
+// flushed, so that they can still be read back by Get.
+type OverflowStore interface {
+	Add(key string, value interface{})
+	Get(key string) (interface{}, bool)
+	Remove(key string)
 }
 
 type CacheInterface interface {
@@ -51,86 +181,537 @@ type CacheInterface interface {
 }
 
 type SimpleCache struct {
-	mu       sync.Mutex
-	data     map[string]*list.Element
-	list     *list.List
-	capacity int
+	lru
 }
 
 var _ CacheInterface = &SimpleCache{}
 
 type Cache struct {
-	mu          sync.Mutex
+	// flushes and flushed are read atomically by FlushCount and come
+	// first to be 64-bit aligned, like the counters of lru.
+	flushes, flushed uint64
+
+	lru
 	flushPeriod time.Duration
-	data        map[string]*list.Element
-	dirtyList   *list.List
-	list        *list.List
-	capacity    int
-	flusher     Flusher
+	dirtyList   list.List
+	// dirtyIndex maps a key to its pending modification in dirtyList, and
+	// inFlight holds the keys of the modifications a flush has taken off it
+	// and is writing. evictedKeys holds the keys evicted since they were
+	// last deleted, which the backing store may hold.
+	dirtyIndex  map[string]*list.Element
+	inFlight    map[string]bool
+	evictedKeys map[string]bool
+	flusher     FlusherWithError
+	adapter     flusherAdapter
 	maxNrDirty  int
+	overflow    OverflowStore
+	flushDelay  time.Duration
+	flushJitter float64
+	flushTimer  timer
+	maxDirtyAge time.Duration
+	ageTimer    timer
+	beforeFlush func(keys []string)
+	onPanic     func(v interface{})
+	flushMu     sync.Mutex
+	// flushing is set while a Flush runs. Flushes are numbered: flushGen
+	// is the number of the latest one started and flushedGen of the
+	// latest one done. flushWait, if not nil, is closed once the running
+	// one is done.
+	flushing   bool
+	flushGen   uint64
+	flushedGen uint64
+	flushWait  chan struct{}
 }
 
 var _ CacheInterface = &Cache{}
 
-func (c *SimpleCache) Len() int {
-	return len(c.data)
+func (c *SimpleCache) Flush() {}
+
+// Flush writes every pending modification to the flusher. Only the last
+// modification of each key is pending, so a key is written at most once
+// per flush, and once every write succeeds the backing store holds what
+// the cache holds for every key modified since the previous flush. The
+// cache is not locked while the flusher is called, so Get and Set do not
+// wait for a slow backing store. A Set racing with Flush is either written
+// by it or left dirty for the next flush, never dropped.
+//
+// Flush calls made while another is running do not each start a flush of
+// their own: they wait for a single flush run on behalf of all of them
+// once the running one is done, so that it covers what they set. A Flush
+// call thus waits for at most the running flush and the one after it.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	// The running flush may have taken the dirty list before this call,
+	// so only one that starts after it will do.
+	target := c.flushGen + 1
+	for c.flushing {
+		if c.flushWait == nil {
+			c.flushWait = make(chan struct{})
+		}
+		wait := c.flushWait
+		c.mu.Unlock()
+		<-wait
+		c.mu.Lock()
+		if c.flushedGen >= target {
+			c.mu.Unlock()
+			return
+		}
+	}
+	c.flushing = true
+	c.flushGen++
+	gen := c.flushGen
+	c.mu.Unlock()
+
+	// The callbacks of the flush run last, once Flush calls may start
+	// flushes again.
+	var released []func()
+	defer func() { runAll(released) }()
+	// This also runs if the flusher panics, so that no Flush call is left
+	// waiting.
+	defer func() {
+		c.mu.Lock()
+		c.flushing = false
+		c.flushedGen = gen
+		wait := c.flushWait
+		c.flushWait = nil
+		c.mu.Unlock()
+		if wait != nil {
+			close(wait)
+		}
+	}()
+	c.flushIf(context.Background(), nil, &released)
+}
+
+// FlushWithResult writes every dirty element to the flusher like Flush,
+// and reports which keys failed. Only the failed keys remain dirty.
+func (c *Cache) FlushWithResult() FlushResult {
+	result, _ := c.flush(context.Background())
+	return result
 }
 
-func (c *Cache) Len() int {
-	return len(c.data)
+// FlushContext writes every dirty element to the flusher like Flush. If
+// the flusher implements FlusherWithContext, ctx is passed to its writes.
+// Once ctx is done, no further writes are started, the rest stays dirty
+// and FlushContext returns ctx.Err(). Otherwise it returns the error of
+// the first write that failed, if any.
+func (c *Cache) FlushContext(ctx context.Context) error {
+	result, err := c.flush(ctx)
+	if err == nil && len(result.Failed) > 0 {
+		err = result.Failed[0].Err
+	}
+	return err
 }
 
-func (c *SimpleCache) Flush() {}
+// FlushErr writes every dirty element to the flusher like Flush and
+// returns the errors of all writes that failed, joined with errors.Join,
+// or nil. The failed elements stay dirty and are retried by the next
+// flush.
+func (c *Cache) FlushErr() error {
+	result, _ := c.flush(context.Background())
+	return result.err()
+}
+
+// Drain is meant as the last call before exiting, also after Close. It
+// waits for any flush in progress, then writes every dirty element to the
+// flusher and returns how many it wrote, along with the failures joined
+// like FlushErr. The cache keeps its entries.
+func (c *Cache) Drain() (int, error) {
+	result, _ := c.flush(context.Background())
+	return result.Succeeded, result.err()
+}
+
+// flush implements FlushWithResult and FlushContext. It returns ctx.Err()
+// if it stopped early because ctx was done.
+//
+// The dirty list is taken out of the cache, so that Get and Set proceed
+// while the flusher is called without c.mu held. Modifications made in
+// the meantime go to a new dirty list and are left for the next flush.
+// flushMu keeps flushes from overlapping, so writes for a key reach the
+// flusher in order.
+//
+// Callbacks such as Observer.OnFlush run once flushMu is released, so that
+// they may flush again.
+func (c *Cache) flush(ctx context.Context) (FlushResult, error) {
+	var released []func()
+	defer func() { runAll(released) }()
+	return c.flushIf(ctx, nil, &released)
+}
+
+// flushIf is like flush, but if due is not nil, it only flushes if due
+// returns true. due is called with c.mu held, under the same lock as the
+// dirty list is taken out with, so the decision cannot go stale in
+// between. The callbacks scheduled by the flush are appended to released
+// for the caller to run.
+func (c *Cache) flushIf(ctx context.Context, due func() bool, released *[]func()) (FlushResult, error) {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
 
-func (c *Cache) Flush() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if due != nil && !due() {
+		c.mu.Unlock()
+		return FlushResult{}, nil
+	}
+	atomic.AddUint64(&c.flushes, 1)
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	c.stopAgeTimer()
+	beforeFlush := c.beforeFlush
+	var keys []string
+	if beforeFlush != nil {
+		keys = c.dirtyKeys()
+	}
+	pending := make([]*dirtyElement, 0, c.dirtyList.Len())
+	if len(c.dirtyIndex) > 0 {
+		c.inFlight = make(map[string]bool, len(c.dirtyIndex))
+	}
 	for e := c.dirtyList.Front(); e != nil; e = e.Next() {
 		if de, ok := e.Value.(*dirtyElement); ok {
-			if de.removed {
-				c.flusher.Remove(de.key)
-			} else if de.modified {
-				c.flusher.Add(de.key, de.value)
+			pending = append(pending, de)
+			c.inFlight[de.key] = true
+		}
+	}
+	c.dirtyList.Init()
+	c.dirtyIndex = nil
+	c.mu.Unlock()
+
+	var result FlushResult
+	var failed map[string]bool
+	var unwritten []*dirtyElement
+	var written []string
+	// next is the index of the modification being written. If the flusher
+	// panics, it and the ones after it are left dirty like failed writes.
+	next := 0
+	defer func() {
+		v := recover()
+		if v != nil {
+			unwritten = append(unwritten, pending[next:]...)
+		}
+		c.mu.Lock()
+		c.inFlight = nil
+		atomic.AddUint64(&c.flushed, uint64(result.Succeeded))
+		c.observeFlush(result.Succeeded)
+		c.requeue(unwritten)
+		for _, key := range written {
+			c.written(key)
+		}
+		*released = append(*released, c.unlockLater()...)
+		if v != nil {
+			panic(v)
+		}
+	}()
+	if beforeFlush != nil {
+		beforeFlush(keys)
+	}
+	ctxErr := ctx.Err()
+	for i, de := range pending {
+		next = i
+		if failed[de.key] {
+			unwritten = append(unwritten, de)
+			continue
+		}
+		if ctxErr == nil {
+			ctxErr = ctx.Err()
+		}
+		var err error
+		if ctxErr == nil {
+			// Otherwise the key is kept dirty without reporting it as failed.
+			err = c.write(ctx, de)
+		}
+		if err != nil || ctxErr != nil {
+			if failed == nil {
+				failed = make(map[string]bool)
+			}
+			failed[de.key] = true
+			unwritten = append(unwritten, de)
+			if err != nil {
+				result.Failed = append(result.Failed, FailedEntry{Key: de.key, Err: err})
 			}
+			continue
 		}
+		result.Succeeded++
+		written = append(written, de.key)
 	}
-	c.dirtyList = list.New()
+	return result, ctxErr
 }
 
-func (c *SimpleCache) debug() {
-	fmt.Printf("nr elems %v <= %v", c.list.Len(), c.capacity)
-	fmt.Println("-----------------elements------------")
-	for e := c.list.Front(); e != nil; e = e.Next() {
-		item := e.Value.(*cacheItem)
-		fmt.Printf("%v: %v\n", item.key, item.value)
+// FlushKey writes the pending modification of key alone to the flusher,
+// leaving the rest of the dirty list for the next flush. It reports
+// whether it wrote anything, which it does not if key is clean, and
+// returns the error of the write that failed, if any, and then key stays
+// dirty.
+func (c *Cache) FlushKey(key string) (flushed bool, err error) {
+	var released []func()
+	defer func() { runAll(released) }()
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	// The dirty list holds at most one element per key.
+	c.mu.Lock()
+	var pending []*dirtyElement
+	if elem, ok := c.dirtyIndex[key]; ok {
+		pending = append(pending, c.dirtyList.Remove(elem).(*dirtyElement))
+		delete(c.dirtyIndex, key)
+		c.inFlight = map[string]bool{key: true}
+	}
+	c.mu.Unlock()
+
+	n := 0
+	for ; n < len(pending); n++ {
+		if err = c.write(context.Background(), pending[n]); err != nil {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	c.inFlight = nil
+	atomic.AddUint64(&c.flushed, uint64(n))
+	c.observeFlush(n)
+	c.requeue(pending[n:])
+	if n > 0 {
+		c.written(key)
 	}
-	fmt.Println("-------------------------------------")
+	released = c.unlockLater()
+	return n > 0, err
 }
 
-func (c *Cache) debug() {
-	fmt.Printf("nr elems %v <= %v, nr dirty elems %v < %v\n",
-		c.list.Len(), c.capacity, c.dirtyList.Len(), c.maxNrDirty)
-	fmt.Println("-----------------elements------------")
-	for e := c.list.Front(); e != nil; e = e.Next() {
-		item := e.Value.(*cacheItem)
-		fmt.Printf("%v: %v\n", item.key, item.value)
+// observeFlush reports a flush of n modifications to the observer, if
+// there is one. The caller must hold c.mu and release it with unlock or
+// unlockLater.
+func (c *Cache) observeFlush(n int) {
+	if o := c.observer; o != nil {
+		c.released = append(c.released, func() { o.OnFlush(n) })
+	}
+}
+
+// write hands de to the flusher, passing ctx along if the flusher takes
+// one.
+func (c *Cache) write(ctx context.Context, de *dirtyElement) error {
+	cf, withContext := c.flusher.(FlusherWithContext)
+	switch {
+	case de.removed && withContext:
+		return cf.RemoveContext(ctx, de.key)
+	case de.removed:
+		return c.flusher.Remove(de.key)
+	case de.modified && withContext:
+		return cf.AddContext(ctx, de.key, de.value)
+	case de.modified:
+		return c.flusher.Add(de.key, de.value)
+	}
+	return nil
+}
+
+// requeue puts modifications that a flush took but did not write back in
+// front of the dirty list. A key modified again during the flush needs
+// only its new modification, which supersedes the unwritten ones. The
+// caller must hold c.mu.
+func (c *Cache) requeue(unwritten []*dirtyElement) {
+	for i := len(unwritten) - 1; i >= 0; i-- {
+		de := unwritten[i]
+		if _, ok := c.dirtyIndex[de.key]; ok {
+			continue
+		}
+		if c.dirtyIndex == nil {
+			c.dirtyIndex = make(map[string]*list.Element)
+		}
+		c.dirtyIndex[de.key] = c.dirtyList.PushFront(de)
+	}
+	if c.dirtyList.Len() > 0 {
+		c.startAgeTimer()
+	}
+}
+
+// written marks key clean after a flush wrote it, unless it was modified
+// again in the meantime. The caller must hold c.mu.
+func (c *Cache) written(key string) {
+	if _, ok := c.dirtyIndex[key]; ok {
+		return
+	}
+	if elem, ok := c.data[key]; ok {
+		elem.Value.(*cacheItem).dirty = false
 	}
-	fmt.Println("-----------dirty elements------------")
+	if c.overflow != nil {
+		c.overflow.Remove(key)
+	}
+}
+
+// SetOverflowStore makes the cache hand evicted entries with unflushed
+// modifications to store, and consult store on a Get miss. An entry is
+// removed from store when it is read back, deleted or flushed.
+func (c *Cache) SetOverflowStore(store OverflowStore) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.overflow = store
+}
+
+// String describes the cache for debugging: its number of entries, its
+// capacity and its entries from the most to the least recently used.
+func (c *SimpleCache) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "nr elems %v <= %v\n", c.list.Len(), c.capacity)
+	c.writeElements(&b)
+	b.WriteString("-------------------------------------\n")
+	return b.String()
+}
+
+func (c *SimpleCache) debug() {
+	fmt.Print(c.String())
+}
+
+// String describes the cache for debugging like SimpleCache.String, and
+// lists its dirty elements too.
+func (c *Cache) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "nr elems %v <= %v, nr dirty elems %v < %v\n",
+		c.list.Len(), c.capacity, c.dirtyList.Len(), c.maxNrDirty)
+	c.writeElements(&b)
+	b.WriteString("-----------dirty elements------------\n")
 	for e := c.dirtyList.Front(); e != nil; e = e.Next() {
 		de := e.Value.(*dirtyElement)
-		fmt.Printf("%v: %v; modified: %v; removed %v\n",
+		fmt.Fprintf(&b, "%v: %v; modified: %v; removed %v\n",
 			de.key, de.value, de.modified, de.removed)
 	}
-	fmt.Println("-------------------------------------")
+	b.WriteString("-------------------------------------\n")
+	return b.String()
+}
+
+func (c *Cache) debug() {
+	fmt.Print(c.String())
 }
 
+// checkAndFlush flushes if maxNrDirty modifications are pending. By the
+// time it gets to flush, another flush may have written them, so the
+// count is checked again as the flush starts.
 func (c *Cache) checkAndFlush() {
 	c.mu.Lock()
-	if c.maxNrDirty >= 0 && c.dirtyList.Len() >= c.maxNrDirty {
+	if !c.tooDirty() {
 		c.mu.Unlock()
-		c.Flush()
-	} else {
+		return
+	}
+	if c.flushDelay > 0 && !c.closed {
+		if c.flushTimer == nil {
+			c.flushTimer = c.time().AfterFunc(c.flushDelay, c.timedFlush)
+		}
 		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	var released []func()
+	defer func() { runAll(released) }()
+	c.flushIf(context.Background(), c.tooDirty, &released)
+}
+
+// tooDirty reports whether maxNrDirty modifications are pending. The
+// caller must hold c.mu.
+func (c *Cache) tooDirty() bool {
+	n := c.dirtyList.Len()
+	return n > 0 && c.maxNrDirty >= 0 && n >= c.maxNrDirty
+}
+
+// SetOnBeforeFlush registers f to be called at the start of every flush
+// with the keys that flush is about to write, in the order they will be
+// written. f runs once the flush has taken those modifications off the
+// dirty list, without the cache locked, so it may use the cache while the
+// flush waits: what it modifies is left for the next flush. It must not
+// flush the cache itself.
+func (c *Cache) SetOnBeforeFlush(f func(keys []string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.beforeFlush = f
+}
+
+// DirtyLen returns the number of modifications waiting to be flushed.
+func (c *Cache) DirtyLen() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dirtyList.Len()
+}
+
+// dirtyKeys returns the distinct keys with pending modifications. The
+// caller must hold c.mu.
+func (c *Cache) dirtyKeys() []string {
+	keys := make([]string, 0, len(c.dirtyIndex))
+	seen := make(map[string]bool, len(c.dirtyIndex))
+	for e := c.dirtyList.Front(); e != nil; e = e.Next() {
+		if de, ok := e.Value.(*dirtyElement); ok && !seen[de.key] {
+			seen[de.key] = true
+			keys = append(keys, de.key)
+		}
+	}
+	return keys
+}
+
+// SetFlushJitter makes the periodic flush wait a random duration of up to
+// fraction * flushPeriod more or less than flushPeriod each time, so that
+// caches created together do not all flush at once. fraction is clamped
+// to [0, 1], and NaN taken as 0; 0, the default, flushes exactly every
+// flushPeriod.
+func (c *Cache) SetFlushJitter(fraction float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !(fraction > 0) {
+		fraction = 0
+	}
+	c.flushJitter = math.Min(1, fraction)
+}
+
+// flushInterval returns how long the periodic flush waits next.
+func (c *Cache) flushInterval() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flushJitter == 0 {
+		return c.flushPeriod
+	}
+	delta := float64(c.flushPeriod) * c.flushJitter
+	return c.flushPeriod + time.Duration(delta*(2*rand.Float64()-1))
+}
+
+// SetFlushDelay makes a flush triggered by reaching maxNrDirty wait for
+// window before running, so that a burst of writes is flushed as one
+// batch. The wait is not extended by later writes, so a continuous stream
+// of writes is still flushed at least once every window. Calling Flush
+// directly is not delayed.
+func (c *Cache) SetFlushDelay(window time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushDelay = window
+}
+
+// SetMaxDirtyAge bounds how long a modification may stay pending: once
+// the oldest one is maxAge old, the cache flushes, however few are
+// pending. Modifications that fail to flush are retried maxAge later. 0,
+// the default, removes the bound. Like the periodic flush, it stops on
+// Close.
+func (c *Cache) SetMaxDirtyAge(maxAge time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxDirtyAge = maxAge
+	c.stopAgeTimer()
+	if c.dirtyList.Len() > 0 {
+		c.startAgeTimer()
+	}
+}
+
+// startAgeTimer arranges for the pending modifications to be flushed once
+// they are maxDirtyAge old, unless that is already arranged. The caller
+// must hold c.mu.
+func (c *Cache) startAgeTimer() {
+	if c.maxDirtyAge > 0 && c.ageTimer == nil && !c.closed {
+		c.ageTimer = c.time().AfterFunc(c.maxDirtyAge, c.timedFlush)
+	}
+}
+
+// stopAgeTimer cancels the flush arranged by startAgeTimer. The caller
+// must hold c.mu.
+func (c *Cache) stopAgeTimer() {
+	if c.ageTimer != nil {
+		c.ageTimer.Stop()
+		c.ageTimer = nil
 	}
 }
 
@@ -138,155 +719,1044 @@ func (c *Cache) checkAndFlush() {
 // capacity < 0 means always in memory;
 // capacity = 0 means no cache.
 //
-// maxNrDirty: < 0 means no flush.
+// maxNrDirty: < 0 means no flush;
+// otherwise the cache flushes once maxNrDirty modifications are pending.
+// maxNrDirty = 0 means write-through: every Set and Delete is written to
+// the flusher before it returns, unless SetFlushDelay is used.
 //
 // flushPeriod:
-// flushPeriod > 1 second means periodically flush;
-// flushPeriod = 0 second means no periodically flush;
-// undefined in range (0, 1).
+// flushPeriod >= 1 second means periodically flush;
+// a shorter or negative flushPeriod means no periodically flush.
+//
+// New panics if flusher is nil. Unlike NewCache and NewWithError, it does
+// not reject sub-second flush periods.
 func New(capacity int, maxNrDirty int, flushPeriod time.Duration, flusher Flusher) *Cache {
-	initialCapacity := capacity
-	if initialCapacity < 0 {
-		initialCapacity = 1024
+	if flusher == nil {
+		panic("Should use NewSimple")
 	}
+	return newWithOptions(options{capacity: capacity, maxNrDirty: maxNrDirty, flushPeriod: flushPeriod, flusher: flusher})
+}
+
+// NewWithErrorFlusher is like New, but takes a flusher whose writes can
+// fail. See FlushWithResult.
+func NewWithErrorFlusher(capacity int, maxNrDirty int, flushPeriod time.Duration, flusher FlusherWithError) *Cache {
 	if flusher == nil {
 		panic("Should use NewSimple")
 	}
+	cache := newCache(capacity, maxNrDirty, flushPeriod)
+	cache.flusher = flusher
+	cache.start()
+	return cache
+}
+
+// Errors returned by NewCache and NewWithError.
+var (
+	ErrNilFlusher  = errors.New("cache2: nil flusher, use NewSimple")
+	ErrFlushPeriod = errors.New("cache2: flushPeriod must be 0 or at least 1 second")
+)
 
+// NewWithError is like New, but returns an error instead of panicking or
+// silently misbehaving on bad arguments: flusher must not be nil, and
+// flushPeriod must be 0 or at least one second.
+func NewWithError(capacity int, maxNrDirty int, flushPeriod time.Duration, flusher Flusher) (*Cache, error) {
+	o := options{capacity: capacity, maxNrDirty: maxNrDirty, flushPeriod: flushPeriod, flusher: flusher}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return newWithOptions(o), nil
+}
+
+func newCache(capacity int, maxNrDirty int, flushPeriod time.Duration) *Cache {
 	cache := new(Cache)
 
 	cache.flushPeriod = flushPeriod
-	cache.capacity = initialCapacity
-	cache.data = make(map[string]*list.Element, initialCapacity)
-	cache.list = list.New()
-	cache.dirtyList = list.New()
-	cache.flusher = flusher
+	cache.capacity = capacity
 	cache.maxNrDirty = maxNrDirty
+	return cache
+}
 
-	if flushPeriod.Seconds() > 0.9 {
-		go func() {
+// start launches the periodic flush, if the cache has one.
+func (c *Cache) start() {
+	if c.flushPeriod.Seconds() > 0.9 {
+		c.background.spawn(func(ctx context.Context) {
+			timer := time.NewTimer(c.flushInterval())
+			defer timer.Stop()
 			for {
-				time.Sleep(flushPeriod)
-				cache.Flush()
+				select {
+				case <-ctx.Done():
+					return
+				case <-timer.C:
+					c.periodicFlush(ctx)
+					timer.Reset(c.flushInterval())
+				}
 			}
-		}()
+		})
 	}
-	return cache
 }
 
-func NewSimple(capacity int) *SimpleCache {
-	initialCapacity := capacity
-	if initialCapacity < 0 {
-		initialCapacity = 1024
+// periodicFlush runs one periodic flush, recovering from a panic in the
+// flusher so that the next period still flushes.
+func (c *Cache) periodicFlush(ctx context.Context) {
+	defer c.recoverFlush()
+	c.FlushContext(ctx)
+}
+
+// timedFlush runs a flush due to SetFlushDelay or SetMaxDirtyAge from its
+// timer, recovering from a panic in the flusher like periodicFlush.
+func (c *Cache) timedFlush() {
+	defer c.recoverFlush()
+	c.Flush()
+}
+
+// recoverFlush hands a panic of a background flush to the handler set by
+// SetPanicHandler, or logs it. It must be deferred.
+func (c *Cache) recoverFlush() {
+	v := recover()
+	if v == nil {
+		return
 	}
-	return &SimpleCache{
-		data:     make(map[string]*list.Element, initialCapacity),
-		list:     list.New(),
-		capacity: initialCapacity,
+	c.mu.RLock()
+	onPanic := c.onPanic
+	c.mu.RUnlock()
+	if onPanic != nil {
+		onPanic(v)
+	} else {
+		log.Printf("cache2: background flush panicked: %v", v)
 	}
 }
 
-func (c *SimpleCache) Get(key string) interface{} {
+// SetPanicHandler makes a panic in the flusher during a periodic flush,
+// or one delayed by SetFlushDelay or SetMaxDirtyAge, call f with the value
+// it panicked with, instead of logging it. Either way the background
+// flushes carry on, and the modifications the panicking flush had not
+// written yet stay dirty for the next one. A nil f goes back to logging.
+// Panics during other flushes are not recovered, but leave the unwritten
+// modifications dirty all the same.
+func (c *Cache) SetPanicHandler(f func(v interface{})) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if elem, ok := c.data[key]; ok {
-		item := elem.Value.(*cacheItem)
-		c.list.MoveToFront(elem)
-		return item.value
+	c.onPanic = f
+}
+
+// Close stops the periodic flush and any delayed flush, waits for them to
+// exit, then flushes whatever is still dirty. Calling Close again does
+// nothing.
+//
+// The cache stays usable after Close, but only as an in-memory cache with
+// synchronous flushing: modifications are written when maxNrDirty is
+// reached or Flush is called, never in the background.
+func (c *Cache) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
 	}
-	return nil
+	c.closed = true
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	c.stopAgeTimer()
+	c.mu.Unlock()
+	c.lru.Close()
+	c.Flush()
+}
+
+// NewSimple creates a SimpleCache holding at most capacity entries.
+// capacity < 0 means always in memory; capacity = 0 means no cache.
+func NewSimple(capacity int) *SimpleCache {
+	c := new(SimpleCache)
+	c.capacity = capacity
+	return c
+}
+
+// NewSimpleWithOrder creates a SimpleCache like NewSimple. If accessOrder
+// is false, it evicts in write order rather than access order: Get does
+// not save an entry from eviction, only Set does. Write order is kept by a
+// WriteOrderPolicy, which SetEvictionPolicy replaces.
+func NewSimpleWithOrder(capacity int, accessOrder bool) *SimpleCache {
+	c := NewSimple(capacity)
+	if !accessOrder {
+		c.policy = NewWriteOrderPolicy()
+	}
+	return c
+}
+
+// NewWithPolicy creates a SimpleCache like NewSimple that evicts the
+// entries chosen by policy, as set by SetEvictionPolicy.
+func NewWithPolicy(capacity int, policy EvictionPolicy) *SimpleCache {
+	c := NewSimple(capacity)
+	c.SetEvictionPolicy(policy)
+	return c
+}
+
+func (c *SimpleCache) Get(key string) interface{} {
+	value, _ := c.GetOK(key)
+	return value
+}
+
+// GetOK is like Get, but also reports whether the key was found, so that
+// a stored nil value can be told apart from a miss.
+func (c *SimpleCache) GetOK(key string) (interface{}, bool) {
+	c.mu.RLock()
+	value, found, ok := c.getShared(key)
+	if ok && !found {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	o := c.observer
+	c.mu.RUnlock()
+	if ok {
+		if o != nil {
+			notifyGet(o, key, found)
+		}
+		return value, found
+	}
+	c.mu.Lock()
+	defer c.unlock()
+	return c.get(key, c.now())
+}
+
+// GetOrCompute returns the value stored under key. On a miss it calls
+// compute, stores the result and returns it. Concurrent callers missing
+// the same key wait for a single call to compute rather than making their
+// own. If compute panics, the waiting callers get nil.
+func (c *SimpleCache) GetOrCompute(key string, compute func() interface{}) interface{} {
+	value, _ := c.getOrCompute(key, func() (interface{}, error) {
+		return compute(), nil
+	}, c.GetOK, c.Set)
+	return value
+}
+
+// GetMany looks up every key in keys, taking the lock once, and returns
+// the values of those found. Each key found counts as accessed, in the
+// order of keys.
+func (c *SimpleCache) GetMany(keys []string) map[string]interface{} {
+	c.mu.Lock()
+	defer c.unlock()
+	values := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		if value, ok := c.get(key, c.now()); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// GetAt is like Get, but records the access at the logical time seq
+// instead of now. Eviction always picks the entry with the smallest seq,
+// so driving a cache only through SetAt and GetAt makes its eviction
+// order fully reproducible. Plain Set and Get count as accesses newer
+// than any seq seen so far.
+func (c *SimpleCache) GetAt(key string, seq uint64) interface{} {
+	c.mu.Lock()
+	defer c.unlock()
+	value, _ := c.get(key, seq)
+	return value
+}
+
+func (c *SimpleCache) get(key string, seq uint64) (interface{}, bool) {
+	if item, ok := c.lookup(key, seq); ok && !c.expire(item) {
+		if value, ok := resolve(item.value); ok {
+			c.hit(item)
+			return value, true
+		}
+		c.remove(key)
+		c.departed(key, Evicted)
+	}
+	c.miss(key)
+	return nil, false
+}
+
+// GetWithReason is like Get, but on a miss also reports why the key is
+// not in the cache. Reasons other than NeverSet are only available after
+// TrackMissReasons has been called.
+func (c *SimpleCache) GetWithReason(key string) (value interface{}, found bool, reason MissReason) {
+	c.mu.Lock()
+	defer c.unlock()
+	if value, found = c.get(key, c.now()); found {
+		return value, true, NotMissed
+	}
+	return nil, false, c.missReason(key)
+}
+
+// GetAndRefreshIfExpiring is like GetOK, but if the entry found expires
+// within window, it also gives the entry newTTL more to live, all under a
+// single lock. This keeps hot entries from expiring without renewing
+// their expiry on every Get. Entries set without an expiry are left
+// alone.
+func (c *SimpleCache) GetAndRefreshIfExpiring(key string, window, newTTL time.Duration) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.unlock()
+	value, found := c.get(key, c.now())
+	if found {
+		c.refreshIfExpiring(key, window, newTTL)
+	}
+	return value, found
 }
 
 func (c *Cache) Get(key string) interface{} {
+	value, _ := c.GetOK(key)
+	return value
+}
+
+// GetOK is like Get, but also reports whether the key was found, so that
+// a stored nil value can be told apart from a miss.
+func (c *Cache) GetOK(key string) (interface{}, bool) {
+	c.mu.RLock()
+	value, found, ok := c.getShared(key)
+	// A miss may still be found in the overflow store.
+	if ok = ok && (found || c.overflow == nil); ok && !found {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	o := c.observer
+	c.mu.RUnlock()
+	if ok {
+		if o != nil {
+			notifyGet(o, key, found)
+		}
+		return value, found
+	}
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if elem, ok := c.data[key]; ok {
-		item := elem.Value.(*cacheItem)
-		c.list.MoveToFront(elem)
-		return item.value
+	defer c.unlock()
+	return c.get(key, c.now())
+}
+
+// GetOrCompute returns the value stored under key, computing and storing
+// it on a miss. See SimpleCache.GetOrCompute.
+func (c *Cache) GetOrCompute(key string, compute func() interface{}) interface{} {
+	value, _ := c.getOrCompute(key, func() (interface{}, error) {
+		return compute(), nil
+	}, c.GetOK, c.Set)
+	return value
+}
+
+// GetMany looks up every key in keys, taking the lock once, and returns
+// the values of those found. See SimpleCache.GetMany.
+func (c *Cache) GetMany(keys []string) map[string]interface{} {
+	c.mu.Lock()
+	defer c.unlock()
+	values := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		if value, ok := c.get(key, c.now()); ok {
+			values[key] = value
+		}
 	}
-	return nil
+	return values
+}
+
+// GetAt is like Get, but records the access at the logical time seq. See
+// SimpleCache.GetAt.
+func (c *Cache) GetAt(key string, seq uint64) interface{} {
+	c.mu.Lock()
+	defer c.unlock()
+	value, _ := c.get(key, seq)
+	return value
+}
+
+func (c *Cache) get(key string, seq uint64) (interface{}, bool) {
+	if item, ok := c.lookup(key, seq); ok {
+		if !c.expire(item) {
+			c.hit(item)
+			return item.value, true
+		}
+		c.miss(key)
+		return nil, false
+	}
+	if item, ok := c.fromOverflow(key, seq); ok {
+		c.hit(item)
+		c.evictOverflow()
+		return item.value, true
+	}
+	c.miss(key)
+	return nil, false
+}
+
+// fromOverflow moves the entry of key from the overflow store back into
+// memory, accessed at seq, if it is there. The caller must hold c.mu and
+// ensure key is not cached in memory.
+func (c *Cache) fromOverflow(key string, seq uint64) (*cacheItem, bool) {
+	value, ok := c.overflowGet(key)
+	if !ok {
+		return nil, false
+	}
+	c.overflow.Remove(key)
+	item := c.insert(key, value, seq)
+	item.dirty = true
+	return item, true
+}
+
+// GetWithReason is like Get, but on a miss also reports why the key is
+// not in the cache. See SimpleCache.GetWithReason.
+func (c *Cache) GetWithReason(key string) (value interface{}, found bool, reason MissReason) {
+	c.mu.Lock()
+	defer c.unlock()
+	if value, found = c.get(key, c.now()); found {
+		return value, true, NotMissed
+	}
+	return nil, false, c.missReason(key)
+}
+
+// GetAndRefreshIfExpiring is like GetOK, but also renews the expiry of an
+// entry about to expire. See SimpleCache.GetAndRefreshIfExpiring.
+func (c *Cache) GetAndRefreshIfExpiring(key string, window, newTTL time.Duration) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.unlock()
+	value, found := c.get(key, c.now())
+	if found {
+		c.refreshIfExpiring(key, window, newTTL)
+	}
+	return value, found
 }
 
 func (c *SimpleCache) Set(key string, value interface{}) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
+	c.mutated()
+	c.set(key, value, c.now())
+	c.shrink()
+}
+
+// Swap stores value under key like Set, and returns the value it
+// replaced and whether there was one.
+func (c *SimpleCache) Swap(key string, value interface{}) (old interface{}, existed bool) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.mutated()
+	old, existed = c.peek(key)
+	c.set(key, value, c.now())
+	c.shrink()
+	return old, existed
+}
+
+// UpdateIfPresent replaces the value stored under key like Set, but only
+// if key is cached. It reports whether it did.
+func (c *SimpleCache) UpdateIfPresent(key string, value interface{}) bool {
+	c.mu.Lock()
+	defer c.unlock()
+	if _, ok := c.peek(key); !ok {
+		return false
+	}
+	c.mutated()
+	c.set(key, value, c.now())
+	c.shrink()
+	return true
+}
+
+// TrySet stores value under key like Set, unless key is not cached and
+// the cache already holds as many entries as its capacity allows. It then
+// stores nothing, rather than evicting an entry, and returns false.
+func (c *SimpleCache) TrySet(key string, value interface{}) bool {
+	c.mu.Lock()
+	defer c.unlock()
+	if _, ok := c.data[key]; !ok && c.full() {
+		return false
+	}
+	c.mutated()
+	c.set(key, value, c.now())
+	c.shrink()
+	return true
+}
+
+// SetIfAbsent stores value under key like Set, but only if key is not
+// cached, and reports whether it did. Unlike GetOrSet, it does not count
+// as an access when key is cached.
+func (c *SimpleCache) SetIfAbsent(key string, value interface{}) bool {
+	c.mu.Lock()
+	defer c.unlock()
+	if _, ok := c.peek(key); ok {
+		return false
+	}
+	c.mutated()
+	c.set(key, value, c.now())
+	c.shrink()
+	return true
+}
+
+// SetIfPresent is UpdateIfPresent, named to pair with SetIfAbsent.
+func (c *SimpleCache) SetIfPresent(key string, value interface{}) bool {
+	return c.UpdateIfPresent(key, value)
+}
 
-	if e, ok := c.data[key]; ok {
-		item := e.Value.(*cacheItem)
-		item.value = value
-		c.list.MoveToFront(e)
+// GetOrSet returns the value stored under key, with loaded true, or
+// stores value under key and returns it, with loaded false, all under a
+// single lock like sync.Map's LoadOrStore. A hit counts as an access.
+func (c *SimpleCache) GetOrSet(key string, value interface{}) (actual interface{}, loaded bool) {
+	c.mu.Lock()
+	defer c.unlock()
+	if actual, loaded = c.get(key, c.now()); loaded {
+		return actual, true
+	}
+	c.mutated()
+	c.set(key, value, c.now())
+	c.shrink()
+	return value, false
+}
+
+// Upsert stores merge(old, value) under key if it holds old, and value
+// otherwise, all under a single lock, so concurrent Upserts of a key
+// combine rather than overwrite each other. merge is used instead of the
+// one set by SetMergeFunc, and is called with the cache locked, so it
+// must not call back into the cache.
+func (c *SimpleCache) Upsert(key string, value interface{}, merge func(old, new interface{}) interface{}) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.mutated()
+	c.upsert(key, value, merge, func(value interface{}) {
+		c.set(key, value, c.now())
+	})
+	c.shrink()
+}
+
+// SetMany stores every entry of entries, taking the lock once. Capacity
+// is enforced after each insert, so the cache never grows past it, and a
+// batch larger than the cache keeps an arbitrary subset of itself.
+func (c *SimpleCache) SetMany(entries map[string]interface{}) {
+	c.mu.Lock()
+	defer c.unlock()
+	for key, value := range entries {
+		c.mutated()
+		c.set(key, value, c.now())
+		c.shrink()
+	}
+}
+
+// SetAt is like Set, but records the access at the logical time seq. See
+// GetAt.
+func (c *SimpleCache) SetAt(key string, value interface{}, seq uint64) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.mutated()
+	c.set(key, value, seq)
+	c.shrink()
+}
+
+// SetWithCleanup is like Set, and arranges for cleanup to be called with
+// value exactly once, when this entry leaves the cache for any reason:
+// eviction, Delete, or a later Set replacing the value. cleanup is called
+// without the cache locked.
+func (c *SimpleCache) SetWithCleanup(key string, value interface{}, cleanup func(value interface{})) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.mutated()
+	c.setCleanup(c.set(key, value, c.now()), cleanup)
+	c.shrink()
+}
+
+// SetWithExpiry is like Set, but the entry expires once ttl has elapsed:
+// Get then treats it as absent and removes it, whatever its position in
+// the LRU list. ttl <= 0 means the entry never expires.
+func (c *SimpleCache) SetWithExpiry(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.mutated()
+	c.expireAfter(c.set(key, value, c.now()), ttl)
+	c.shrink()
+}
+
+// set stores value under key without enforcing the capacity. The caller
+// must hold c.mu.
+func (c *SimpleCache) set(key string, value interface{}, seq uint64) *cacheItem {
+	c.observe(setEvent, key)
+	item, ok := c.lookup(key, seq)
+	if ok {
+		c.update(item, value)
 	} else {
-		elem := c.list.PushFront(&cacheItem{key: key, value: value})
-		c.data[key] = elem
-		if c.capacity >= 0 && len(c.data) > c.capacity {
-			last := c.list.Back()
-			item := last.Value.(*cacheItem)
-			c.list.Remove(last)
-			delete(c.data, item.key)
-		}
+		item = c.insert(key, value, seq)
 	}
-	return
+	c.rejectOversized(item)
+	return item
 }
 
 func (c *Cache) Set(key string, value interface{}) {
 	c.mu.Lock()
 	defer c.checkAndFlush()
-	defer c.mu.Unlock()
+	defer c.unlock()
+	c.mutated()
+	c.set(key, value, c.now())
+	c.evictOverflow()
+}
+
+// Swap stores value under key like Set, and returns the value it
+// replaced in memory and whether there was one. See SimpleCache.Swap.
+func (c *Cache) Swap(key string, value interface{}) (old interface{}, existed bool) {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	c.mutated()
+	old, existed = c.peek(key)
+	c.set(key, value, c.now())
+	c.evictOverflow()
+	return old, existed
+}
+
+// UpdateIfPresent replaces the value stored under key like Set, but only
+// if key is in memory. Entries in the overflow store are left alone. It
+// reports whether it updated the entry.
+func (c *Cache) UpdateIfPresent(key string, value interface{}) bool {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	if _, ok := c.peek(key); !ok {
+		return false
+	}
+	c.mutated()
+	c.set(key, value, c.now())
+	c.evictOverflow()
+	return true
+}
+
+// TrySet stores value under key like Set, unless that would evict an
+// entry. It records a modification for the flusher only if it stores
+// value. See SimpleCache.TrySet.
+func (c *Cache) TrySet(key string, value interface{}) bool {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	if _, ok := c.data[key]; !ok && c.full() {
+		return false
+	}
+	c.mutated()
+	c.set(key, value, c.now())
+	c.evictOverflow()
+	return true
+}
+
+// SetIfAbsent stores value under key like Set, but only if key is not
+// cached, in memory or in the overflow store. It records a modification
+// for the flusher only if it stores value. See SimpleCache.SetIfAbsent.
+func (c *Cache) SetIfAbsent(key string, value interface{}) bool {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	if _, ok := c.peek(key); ok {
+		return false
+	}
+	if _, ok := c.overflowGet(key); ok {
+		return false
+	}
+	c.mutated()
+	c.set(key, value, c.now())
+	c.evictOverflow()
+	return true
+}
+
+// SetIfPresent stores value under key like Set, but only if key is
+// cached, in memory or in the overflow store, and reports whether it did.
+// Unlike UpdateIfPresent, it also replaces an entry in the overflow store,
+// bringing it back into memory.
+func (c *Cache) SetIfPresent(key string, value interface{}) bool {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	if _, ok := c.peek(key); !ok {
+		if _, ok := c.fromOverflow(key, c.now()); !ok {
+			return false
+		}
+	}
+	c.mutated()
+	c.set(key, value, c.now())
+	c.evictOverflow()
+	return true
+}
 
-	de := &dirtyElement{
-		modified: true,
-		removed:  false,
+// GetOrSet returns the value stored under key or stores value under it.
+// See SimpleCache.GetOrSet.
+func (c *Cache) GetOrSet(key string, value interface{}) (actual interface{}, loaded bool) {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	if actual, loaded = c.get(key, c.now()); loaded {
+		return actual, true
+	}
+	c.mutated()
+	c.set(key, value, c.now())
+	c.evictOverflow()
+	return value, false
+}
+
+// Upsert stores value under key, merged with the value already there in
+// memory or in the overflow store, and marks the result dirty, so the
+// merged value is what gets flushed. See SimpleCache.Upsert.
+func (c *Cache) Upsert(key string, value interface{}, merge func(old, new interface{}) interface{}) {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	c.mutated()
+	if _, ok := c.data[key]; !ok {
+		c.fromOverflow(key, c.now())
+	}
+	c.upsert(key, value, merge, func(value interface{}) {
+		c.set(key, value, c.now())
+	})
+	c.evictOverflow()
+}
+
+// SetMany stores every entry of entries, taking the lock once, and checks
+// whether to flush once after the whole batch. See SimpleCache.SetMany.
+func (c *Cache) SetMany(entries map[string]interface{}) {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	for key, value := range entries {
+		c.mutated()
+		c.set(key, value, c.now())
+		c.evictOverflow()
+	}
+}
+
+// SetAt is like Set, but records the access at the logical time seq. See
+// SimpleCache.GetAt.
+func (c *Cache) SetAt(key string, value interface{}, seq uint64) {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	c.mutated()
+	c.set(key, value, seq)
+	c.evictOverflow()
+}
+
+// SetWithCleanup is like Set, and arranges for cleanup to be called once
+// the entry leaves the cache. See SimpleCache.SetWithCleanup.
+func (c *Cache) SetWithCleanup(key string, value interface{}, cleanup func(value interface{})) {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	c.mutated()
+	c.setCleanup(c.set(key, value, c.now()), cleanup)
+	c.evictOverflow()
+}
+
+// SetWithExpiry is like Set, but the entry expires once ttl has elapsed.
+// Expiry only drops the entry from memory, like eviction: the backing
+// store keeps the value. See SimpleCache.SetWithExpiry.
+func (c *Cache) SetWithExpiry(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	c.mutated()
+	c.expireAfter(c.set(key, value, c.now()), ttl)
+	c.evictOverflow()
+}
+
+// set stores value under key and records the modification, without
+// enforcing the capacity. The caller must hold c.mu.
+func (c *Cache) set(key string, value interface{}, seq uint64) *cacheItem {
+	c.observe(setEvent, key)
+	item, ok := c.lookup(key, seq)
+	if ok {
+		value = c.update(item, value)
+	} else {
+		item = c.insert(key, value, seq)
+	}
+	item.dirty = true
+	c.recordDirty(key, value, false)
+	return item
+}
+
+// recordDirty records a modification of key for the flusher: its removal,
+// or else value being set. The caller must hold c.mu.
+func (c *Cache) recordDirty(key string, value interface{}, removed bool) {
+	// The key's pending modification is superseded by this one, so it can
+	// be reused instead of queueing another.
+	if elem, ok := c.dirtyIndex[key]; ok {
+		de := elem.Value.(*dirtyElement)
+		de.modified = !removed
+		de.removed = removed
+		de.value = value
+		return
+	}
+	c.pushDirty(&dirtyElement{
+		modified: !removed,
+		removed:  removed,
 		key:      key,
 		value:    value,
+	})
+}
+
+// pushDirty queues de to be flushed. The caller must hold c.mu.
+func (c *Cache) pushDirty(de *dirtyElement) {
+	if c.dirtyIndex == nil {
+		c.dirtyIndex = make(map[string]*list.Element)
 	}
+	c.dirtyIndex[de.key] = c.dirtyList.PushBack(de)
+	c.startAgeTimer()
+}
 
-	if e, ok := c.data[key]; ok {
-		item := e.Value.(*cacheItem)
-		item.value = value
-		c.list.MoveToFront(e)
-		c.dirtyList.PushBack(de)
-	} else {
-		elem := c.list.PushFront(&cacheItem{key: key, value: value})
-		c.data[key] = elem
-		c.dirtyList.PushBack(de)
-		if c.capacity >= 0 && len(c.data) > c.capacity {
-			last := c.list.Back()
-			item := last.Value.(*cacheItem)
-			c.list.Remove(last)
-			delete(c.data, item.key)
+// evictOverflow evicts entries until the cache is within capacity, moving
+// dirty ones to the overflow store, and returns how many it evicted. The
+// caller must hold c.mu.
+func (c *Cache) evictOverflow() (evicted int) {
+	for item := c.evict(); item != nil; item = c.evict() {
+		if item.dirty && c.overflow != nil {
+			c.overflow.Add(item.key, item.value)
+		}
+		if c.evictedKeys == nil {
+			c.evictedKeys = make(map[string]bool)
 		}
+		c.evictedKeys[item.key] = true
+		evicted++
 	}
-	return
+	return evicted
 }
 
 func (c *SimpleCache) Delete(key string) interface{} {
+	value, _ := c.Remove(key)
+	return value
+}
+
+// Remove is like Delete, but also reports whether key was cached, so that
+// removing a stored nil value can be told apart from removing nothing.
+func (c *SimpleCache) Remove(key string) (value interface{}, existed bool) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.mutated()
+
+	if item, ok := c.remove(key); ok {
+		c.departed(key, Deleted)
+		c.observe(deleteEvent, key)
+		value, _ := resolve(item.value)
+		return value, true
+	}
+	return nil, false
+}
+
+// DrainAll atomically empties the cache and returns everything it held.
+// Cleanups registered with SetWithCleanup are not run, since ownership of
+// the values passes to the caller.
+func (c *SimpleCache) DrainAll() map[string]interface{} {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.drain()
+}
 
-	if elem, ok := c.data[key]; ok {
-		delete(c.data, key)
-		item := elem.Value.(*cacheItem)
-		return item.value
+// DrainAll flushes every pending modification, then atomically empties
+// the cache and returns everything it held. The drained entries are only
+// dropped from memory: the backing store keeps them. Cleanups registered
+// with SetWithCleanup are not run.
+func (c *Cache) DrainAll() map[string]interface{} {
+	c.Flush()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.drain()
+}
+
+// Clear removes every entry, keeping the cache's configuration.
+func (c *SimpleCache) Clear() {
+	c.mu.Lock()
+	defer c.unlock()
+	c.mutated()
+	c.clear()
+}
+
+// Clear flushes every pending modification, then removes every entry
+// from memory, keeping the cache's configuration. The backing store keeps
+// the entries. Modifications that fail to flush stay pending and are
+// retried by the next Flush.
+func (c *Cache) Clear() {
+	c.Flush()
+	c.mu.Lock()
+	defer c.unlock()
+	c.mutated()
+	c.clear()
+}
+
+// Resize changes the capacity of the cache to capacity, with the same
+// meaning as for NewSimple, and evicts the least recently used entries
+// that no longer fit. It returns how many were evicted.
+func (c *SimpleCache) Resize(capacity int) (evicted int) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.capacity = capacity
+	for c.evict() != nil {
+		evicted++
 	}
-	return nil
+	return evicted
 }
 
-func (c *Cache) Delete(key string) interface{} {
+// Resize changes the capacity of the cache like SimpleCache.Resize.
+// Evicted entries with pending modifications stay dirty, and move to the
+// overflow store if there is one.
+func (c *Cache) Resize(capacity int) (evicted int) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.capacity = capacity
+	return c.evictOverflow()
+}
+
+// Purge removes every entry like Clear, but instead of flushing first it
+// records the removal of every cached or pending key, so that the next
+// Flush deletes them from the backing store too.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.unlock()
+	c.mutated()
+	keys := make([]string, 0, len(c.data)+len(c.dirtyIndex))
+	for key := range c.data {
+		keys = append(keys, key)
+	}
+	for key := range c.dirtyIndex {
+		if _, ok := c.data[key]; !ok {
+			keys = append(keys, key)
+			if c.overflow != nil {
+				c.overflow.Remove(key)
+			}
+		}
+	}
+	c.clear()
+	for _, key := range keys {
+		c.observe(deleteEvent, key)
+		c.recordDirty(key, nil, true)
+	}
+}
+
+// RemoveFunc deletes every entry for which match returns true, taking
+// the lock once, and returns how many it deleted. match is called with
+// the cache locked and must not call back into it.
+func (c *SimpleCache) RemoveFunc(match func(key string, value interface{}) bool) int {
+	c.mu.Lock()
+	defer c.unlock()
+	c.mutated()
+	return len(c.removeFunc(match))
+}
+
+// RemoveFunc deletes every entry in memory for which match returns true
+// and records their removal for the flusher. See SimpleCache.RemoveFunc.
+func (c *Cache) RemoveFunc(match func(key string, value interface{}) bool) int {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	c.mutated()
+	removed := c.removeFunc(match)
+	for _, key := range removed {
+		c.recordDirty(key, nil, true)
+	}
+	return len(removed)
+}
+
+// ExtractHottest removes the k most recently used entries and returns
+// them, most recent first, for seeding another cache with the warm set.
+func (c *SimpleCache) ExtractHottest(k int) []Entry {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.extractHottest(k)
+}
 
-	de := &dirtyElement{
-		modified: false,
-		removed:  true,
-		key:      key,
-		value:    nil,
+// Snapshot returns every entry, most recently used first, for restoring
+// into another cache with Restore.
+func (c *SimpleCache) Snapshot() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snapshot()
+}
+
+// Restore stores entries, as returned by Snapshot, so that they keep
+// their order: the first entry ends up the most recently used. If there
+// are more entries than the cache can hold, the last ones are evicted.
+func (c *SimpleCache) Restore(entries []Entry) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.restore(entries)
+	c.shrink()
+}
+
+// Snapshot returns every entry, most recently used first. See
+// SimpleCache.Snapshot.
+func (c *Cache) Snapshot() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snapshot()
+}
+
+// Restore stores entries, as returned by Snapshot, keeping their order.
+// The entries are taken to be in the backing store already, so nothing is
+// recorded for the flusher. Restore is meant for an empty cache: an entry
+// replacing a cached one leaves its dirty state as it was. See
+// SimpleCache.Restore.
+func (c *Cache) Restore(entries []Entry) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.restore(entries)
+	c.evictOverflow()
+}
+
+// ExtractHottest removes the k most recently used entries and returns
+// them, most recent first. The entries are only dropped from memory:
+// their pending modifications are still flushed and no removal is
+// recorded for them.
+func (c *Cache) ExtractHottest(k int) []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.extractHottest(k)
+}
+
+// OrderingSnapshot returns the keys of the cache from most to least
+// recently used, with their metadata but not their values.
+func (c *SimpleCache) OrderingSnapshot() []KeyMeta {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.orderingSnapshot()
+}
+
+// OrderingSnapshot returns the keys of the cache from most to least
+// recently used, with their metadata but not their values.
+func (c *Cache) OrderingSnapshot() []KeyMeta {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.orderingSnapshot()
+}
+
+// Delete removes key from the cache and records the removal for the
+// flusher. Keys the cache does not know about, because they are neither
+// cached, in the overflow store nor waiting to be flushed, are left alone
+// and the flusher is not told about them, unless the backing store may
+// still hold them: deleting a key the cache evicted is recorded, as is
+// every Delete in a write-through cache, and in a cache of capacity 0,
+// which never holds the keys it flushes.
+func (c *Cache) Delete(key string) interface{} {
+	value, _ := c.Remove(key)
+	return value
+}
+
+// Remove is like Delete, but also reports whether key was cached, in
+// memory or in the overflow store. A removal is recorded for the flusher
+// whenever it did, and also when key only has a modification pending.
+func (c *Cache) Remove(key string) (value interface{}, existed bool) {
+	c.mu.Lock()
+	defer c.checkAndFlush()
+	defer c.unlock()
+	c.mutated()
+
+	if item, ok := c.remove(key); ok {
+		c.departed(key, Deleted)
+		value, existed = item.value, true
+	} else if v, ok := c.overflowGet(key); ok {
+		c.overflow.Remove(key)
+		c.departed(key, Deleted)
+		value, existed = v, true
+	} else if !c.mayBeStored(key) {
+		return nil, false
 	}
-	c.dirtyList.PushBack(de)
-	if elem, ok := c.data[key]; ok {
-		delete(c.data, key)
-		item := elem.Value.(*cacheItem)
-		return item.value
+	c.observe(deleteEvent, key)
+	c.recordDirty(key, nil, true)
+	delete(c.evictedKeys, key)
+	return value, existed
+}
+
+// mayBeStored reports whether the backing store may hold key, or will
+// once the pending modifications are flushed, although key is not cached.
+// The caller must hold c.mu.
+func (c *Cache) mayBeStored(key string) bool {
+	if _, ok := c.dirtyIndex[key]; ok {
+		return true
 	}
-	return nil
+	return c.inFlight[key] || c.evictedKeys[key] || c.maxNrDirty == 0 || c.capacity == 0
+}
+
+// overflowGet looks key up in the overflow store, if there is one. The
+// caller must hold c.mu.
+func (c *Cache) overflowGet(key string) (interface{}, bool) {
+	if c.overflow == nil {
+		return nil, false
+	}
+	return c.overflow.Get(key)
 }
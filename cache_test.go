@@ -18,7 +18,15 @@
 package cache2
 
 import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -192,6 +200,70 @@ func TestFlushOnTimeOut(t *testing.T) {
 	}
 }
 
+// panicOnceFlusher panics on its first Add, like a flusher with a bug
+// that only shows up on some values.
+type panicOnceFlusher struct {
+	*memFlusher
+	panicked bool
+}
+
+func (f *panicOnceFlusher) Add(key string, value interface{}) {
+	if !f.panicked {
+		f.panicked = true
+		panic("nil map")
+	}
+	f.memFlusher.Add(key, value)
+}
+
+func TestPeriodicFlushSurvivesPanic(t *testing.T) {
+	f := &panicOnceFlusher{memFlusher: newMemFlusher()}
+	c := New(5, -1, 1*time.Second, f)
+	defer c.Close()
+	panics := make(chan interface{}, 1)
+	c.SetPanicHandler(func(v interface{}) { panics <- v })
+
+	c.Set("key1", "1")
+	select {
+	case v := <-panics:
+		if v != "nil map" {
+			t.Errorf("the handler should get the panic value. Got %v", v)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the panic should be reported")
+	}
+
+	c.Set("key2", "2")
+	time.Sleep(2 * time.Second)
+	if _, ok := f.threadSafeGet("key2"); !ok {
+		t.Errorf("the periodic flush should keep running after a panic")
+	}
+	if v, _ := f.threadSafeGet("key1"); v != "1" {
+		t.Errorf("the modification the panic interrupted should be flushed later. Got %v", v)
+	}
+}
+
+func TestDelayedFlushSurvivesPanic(t *testing.T) {
+	f := &panicOnceFlusher{memFlusher: newMemFlusher()}
+	clk := newFakeClock()
+	c := New(5, 1, 0*time.Second, f)
+	c.clock = clk
+	c.SetFlushDelay(time.Second)
+	var panics []interface{}
+	c.SetPanicHandler(func(v interface{}) { panics = append(panics, v) })
+
+	c.Set("key1", "1")
+	clk.Advance(time.Second)
+	if len(panics) != 1 || panics[0] != "nil map" {
+		t.Errorf("the handler should get the panic of the delayed flush. Got %v", panics)
+	}
+
+	c.Set("key2", "2")
+	clk.Advance(time.Second)
+	if v, _ := f.threadSafeGet("key1"); v != "1" {
+		t.Errorf("the modification the panic interrupted should be flushed later. Got %v", v)
+	}
+}
+
 func TestEvictValue(t *testing.T) {
 	kv := make(map[string]string)
 	kv["key1"] = "1"
@@ -292,3 +364,2598 @@ func TestSimpleCacheEvictsOldValues(t *testing.T) {
 func TestFlushingCacheEvictsOldValues(t *testing.T) {
 	testEvictsOldValuesHelper(t, newMemFlusher(), 0*time.Second)
 }
+
+type memOverflowStore struct {
+	data map[string]interface{}
+}
+
+func (s *memOverflowStore) Add(key string, value interface{}) {
+	s.data[key] = value
+}
+
+func (s *memOverflowStore) Get(key string) (interface{}, bool) {
+	value, ok := s.data[key]
+	return value, ok
+}
+
+func (s *memOverflowStore) Remove(key string) {
+	delete(s.data, key)
+}
+
+func TestEvictedDirtyEntriesOverflow(t *testing.T) {
+	f := newMemFlusher()
+	store := &memOverflowStore{data: make(map[string]interface{})}
+
+	c := New(2, -1, 0*time.Second, f)
+	c.SetOverflowStore(store)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+
+	if v, ok := store.data["key1"]; !ok || v != "1" {
+		t.Errorf("key1 should be in the overflow store. Got %v", v)
+	}
+	expectCachedValueEquals(t, c, "key1", "1")
+	if _, ok := store.data["key1"]; ok {
+		t.Errorf("key1 should leave the overflow store once read back")
+	}
+	// Reading key1 back evicted key2, which is still dirty.
+	if _, ok := store.data["key2"]; !ok {
+		t.Errorf("key2 should be in the overflow store")
+	}
+
+	c.Flush()
+	if len(store.data) != 0 {
+		t.Errorf("flushed entries should leave the overflow store: %v", store.data)
+	}
+	c.Set("key4", "4")
+	if _, ok := store.data["key3"]; ok {
+		t.Errorf("clean entry key3 should not be in the overflow store")
+	}
+}
+
+func TestUnusedCacheAllocatesMinimally(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		c := NewSimple(1024)
+		c.Get("key1")
+		c.Delete("key1")
+		c.Len()
+	})
+	if allocs > 1 {
+		t.Errorf("unused SimpleCache made %v allocations", allocs)
+	}
+
+	f := newMemFlusher()
+	allocs = testing.AllocsPerRun(100, func() {
+		c := New(1024, -1, 0*time.Second, f)
+		c.Get("key1")
+		c.Len()
+		c.Flush()
+	})
+	if allocs > 1 {
+		t.Errorf("unused Cache made %v allocations", allocs)
+	}
+}
+
+func TestLazilyInitializedCache(t *testing.T) {
+	c := NewSimple(2)
+	if c.Len() != 0 {
+		t.Errorf("empty cache has length %v", c.Len())
+	}
+	if v := c.Get("key1"); v != nil {
+		t.Errorf("Got %v from an empty cache", v)
+	}
+	if v := c.Delete("key1"); v != nil {
+		t.Errorf("Deleted %v from an empty cache", v)
+	}
+	c.Set("key1", "1")
+	expectCachedValueEquals(t, c, "key1", "1")
+	if c.Len() != 1 {
+		t.Errorf("cache should have 1 element. Got %v", c.Len())
+	}
+
+	f := newMemFlusher()
+	fc := New(2, -1, 0*time.Second, f)
+	fc.Flush()
+	if v := fc.Get("key1"); v != nil {
+		t.Errorf("Got %v from an empty cache", v)
+	}
+	fc.Set("key1", "1")
+	fc.Flush()
+	if v, ok := f.threadSafeGet("key1"); !ok || v != "1" {
+		t.Errorf("key1 was not flushed. Got %v", v)
+	}
+}
+
+func TestLogicalClockEviction(t *testing.T) {
+	c := NewSimple(3)
+	c.SetAt("key1", "1", 10)
+	c.SetAt("key2", "2", 20)
+	c.SetAt("key3", "3", 30)
+	c.GetAt("key2", 40)
+	c.GetAt("key1", 35)
+
+	c.SetAt("key4", "4", 50)
+	if _, ok := c.data["key3"]; ok {
+		t.Errorf("key3 should have been evicted, as it is the smallest seq entry")
+	}
+	c.SetAt("key5", "5", 5)
+	if _, ok := c.data["key5"]; ok {
+		t.Errorf("key5 should have been evicted, as it is an out of date insert")
+	}
+	c.SetAt("key6", "6", 60)
+	if _, ok := c.data["key1"]; ok {
+		t.Errorf("key1 should have been evicted, as it is the smallest seq entry")
+	}
+	expectCachedValueEquals(t, c, "key2", "2")
+	expectCachedValueEquals(t, c, "key4", "4")
+	expectCachedValueEquals(t, c, "key6", "6")
+}
+
+func sumInts(old, new interface{}) interface{} {
+	return old.(int) + new.(int)
+}
+
+func TestMergeFunc(t *testing.T) {
+	c := NewSimple(5)
+	c.SetMergeFunc(sumInts)
+	for i := 1; i <= 4; i++ {
+		c.Set("key1", i)
+	}
+	if v := c.Get("key1"); v != 10 {
+		t.Errorf("should be 10 on key1. Got %v", v)
+	}
+
+	f := newMemFlusher()
+	fc := New(5, -1, 0*time.Second, f)
+	fc.SetMergeFunc(sumInts)
+	fc.Set("key1", 1)
+	fc.Set("key1", 2)
+	fc.Set("key1", 3)
+	fc.Flush()
+	if v, _ := f.threadSafeGet("key1"); v != 6 {
+		t.Errorf("flusher should see the merged value 6 on key1. Got %v", v)
+	}
+}
+
+func TestHugeCapacity(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	c := NewSimple(1 << 40)
+	for i := 0; i < maxPreallocation+10; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+		t.Errorf("allocated %v bytes for %v entries", allocated, c.Len())
+	}
+	if c.Len() != maxPreallocation+10 {
+		t.Errorf("cache should hold every entry. Got %v", c.Len())
+	}
+}
+
+type failingFlusher struct {
+	*memFlusher
+	fail map[string]bool
+}
+
+func (f *failingFlusher) Add(key string, value interface{}) error {
+	if f.fail[key] {
+		return fmt.Errorf("cannot write %v", key)
+	}
+	f.memFlusher.Add(key, value)
+	return nil
+}
+
+func (f *failingFlusher) Remove(key string) error {
+	if f.fail[key] {
+		return fmt.Errorf("cannot remove %v", key)
+	}
+	f.memFlusher.Remove(key)
+	return nil
+}
+
+func TestFlushWithResult(t *testing.T) {
+	f := &failingFlusher{memFlusher: newMemFlusher(), fail: map[string]bool{"key2": true}}
+	c := NewWithErrorFlusher(5, -1, 0*time.Second, f)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+	c.Delete("key2")
+
+	result := c.FlushWithResult()
+	if result.Succeeded != 2 {
+		t.Errorf("should have flushed 2 elements. Got %v", result.Succeeded)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].Key != "key2" || result.Failed[0].Err == nil {
+		t.Errorf("only key2 should have failed. Got %v", result.Failed)
+	}
+	if c.dirtyList.Len() != 1 {
+		c.debug()
+		t.Errorf("the removal of key2 should remain dirty")
+	}
+
+	delete(f.fail, "key2")
+	result = c.FlushWithResult()
+	if result.Succeeded != 1 || len(result.Failed) != 0 {
+		t.Errorf("retry should flush key2. Got %+v", result)
+	}
+	if _, ok := f.threadSafeGet("key2"); ok {
+		t.Errorf("key2 should have been removed")
+	}
+	if c.dirtyList.Len() != 0 {
+		t.Errorf("nothing should remain dirty")
+	}
+}
+
+func TestFlushErrJoinsFailures(t *testing.T) {
+	f := &failingFlusher{memFlusher: newMemFlusher(), fail: map[string]bool{"key1": true, "key3": true}}
+	c := NewWithErrorFlusher(5, -1, 0*time.Second, f)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+
+	err := c.FlushErr()
+	if err == nil || !strings.Contains(err.Error(), "key1") || !strings.Contains(err.Error(), "key3") {
+		t.Errorf("should report the failures of key1 and key3. Got %v", err)
+	}
+	if _, ok := c.dirtyIndex["key1"]; !ok {
+		t.Errorf("key1 should remain dirty")
+	}
+	if _, ok := c.dirtyIndex["key2"]; ok {
+		t.Errorf("key2 should have been flushed")
+	}
+
+	f.fail = nil
+	if err := c.FlushErr(); err != nil {
+		t.Errorf("retry should succeed. Got %v", err)
+	}
+	if v, ok := f.threadSafeGet("key1"); !ok || v != "1" {
+		t.Errorf("key1 should have been written on retry. Got %v", v)
+	}
+}
+
+func TestPurgeRemovesFromBackingStore(t *testing.T) {
+	f := newMemFlusher()
+	c := New(5, -1, 0*time.Second, f)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Flush()
+	c.Set("key3", "3")
+	c.Purge()
+	if c.Len() != 0 {
+		t.Errorf("cache should be empty. Got %v entries", c.Len())
+	}
+	if v := c.Get("key1"); v != nil {
+		t.Errorf("key1 should be purged. Got %v", v)
+	}
+	c.Flush()
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if v, ok := f.threadSafeGet(key); ok {
+			t.Errorf("%v should be removed from the flusher. Got %v", key, v)
+		}
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	caches := []interface {
+		CacheInterface
+		GetOrSet(key string, value interface{}) (interface{}, bool)
+	}{NewSimple(5), New(5, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		winners := 0
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				actual, loaded := c.GetOrSet("key1", i)
+				mu.Lock()
+				defer mu.Unlock()
+				if !loaded {
+					winners++
+					if actual != i {
+						t.Errorf("the inserted value should be returned. Got %v", actual)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		if winners != 1 {
+			t.Errorf("exactly one GetOrSet should insert. Got %v", winners)
+		}
+		if actual, loaded := c.GetOrSet("key1", "other"); !loaded || actual == "other" {
+			t.Errorf("the stored value should be returned. Got %v", actual)
+		}
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	sum := func(old, new interface{}) interface{} { return old.(int) + new.(int) }
+	f := newMemFlusher()
+	caches := []interface {
+		CacheInterface
+		SetMergeFunc(merge func(old, new interface{}) interface{})
+		Upsert(key string, value interface{}, merge func(old, new interface{}) interface{})
+	}{NewSimple(5), New(5, -1, 0*time.Second, f)}
+	for _, c := range caches {
+		// Upsert's merge is used instead of the cache's own.
+		c.SetMergeFunc(func(old, new interface{}) interface{} { return new })
+		for i := 1; i <= 10; i++ {
+			c.Upsert("key1", i, sum)
+		}
+		if v := c.Get("key1"); v != 55 {
+			t.Errorf("Upserts should sum to 55. Got %v", v)
+		}
+	}
+	caches[1].(*Cache).Flush()
+	if v, _ := f.threadSafeGet("key1"); v != 55 {
+		t.Errorf("the merged value should be flushed. Got %v", v)
+	}
+}
+
+func TestUpsertMergesOverflowedValue(t *testing.T) {
+	sum := func(old, new interface{}) interface{} { return old.(int) + new.(int) }
+	f := newMemFlusher()
+	store := &memOverflowStore{data: make(map[string]interface{})}
+	c := New(1, -1, 0*time.Second, f)
+	c.SetOverflowStore(store)
+	c.Set("key1", 1)
+	c.Set("key2", 2)
+	if _, ok := store.data["key1"]; !ok {
+		t.Fatalf("key1 should be in the overflow store")
+	}
+	c.Upsert("key1", 5, sum)
+	if v := c.Get("key1"); v != 6 {
+		t.Errorf("Upsert should merge with the overflowed value. Got %v", v)
+	}
+	c.Flush()
+	if v, _ := f.threadSafeGet("key1"); v != 6 {
+		t.Errorf("the merged value should be flushed. Got %v", v)
+	}
+}
+
+func TestResize(t *testing.T) {
+	f := newMemFlusher()
+	caches := []CacheInterface{NewSimple(3), New(3, -1, 0*time.Second, f)}
+	for _, c := range caches {
+		var resize func(int) int
+		switch c := c.(type) {
+		case *SimpleCache:
+			resize = c.Resize
+		case *Cache:
+			resize = c.Resize
+		}
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		c.Set("key3", "3")
+		if n := resize(5); n != 0 {
+			t.Errorf("growing should evict nothing. Got %v", n)
+		}
+		c.Set("key4", "4")
+		c.Set("key5", "5")
+		if c.Len() != 5 {
+			t.Errorf("cache should hold 5 entries. Got %v", c.Len())
+		}
+		c.Get("key1")
+		if n := resize(2); n != 3 {
+			t.Errorf("shrinking should evict 3 entries. Got %v", n)
+		}
+		for _, key := range []string{"key2", "key3", "key4"} {
+			if v := c.Get(key); v != nil {
+				t.Errorf("%v should be evicted. Got %v", key, v)
+			}
+		}
+		expectCachedValueEquals(t, c, "key1", "1")
+		expectCachedValueEquals(t, c, "key5", "5")
+		if n := resize(-1); n != 0 {
+			t.Errorf("unbounding should evict nothing. Got %v", n)
+		}
+		for i := 0; i < 10; i++ {
+			c.Set(strconv.Itoa(i), strconv.Itoa(i))
+		}
+		if c.Len() != 12 {
+			t.Errorf("cache should be unbounded. Got %v entries", c.Len())
+		}
+	}
+	// Evicted modifications are still flushed.
+	caches[1].Flush()
+	if v, _ := f.threadSafeGet("key2"); v != "2" {
+		t.Errorf("key2 should be flushed. Got %v", v)
+	}
+}
+
+func expectMissReason(t *testing.T, c *SimpleCache, k string, expected MissReason) {
+	value, found, reason := c.GetWithReason(k)
+	if found || value != nil {
+		t.Errorf("%v should be a miss. Got %v", k, value)
+	}
+	if reason != expected {
+		t.Errorf("%v should be missed as %v. Got %v", k, expected, reason)
+	}
+}
+
+func TestMissReasons(t *testing.T) {
+	c := NewSimple(2)
+	c.TrackMissReasons(2)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+	c.Delete("key2")
+
+	expectMissReason(t, c, "notexist", NeverSet)
+	expectMissReason(t, c, "key1", Evicted)
+	expectMissReason(t, c, "key2", Deleted)
+	if _, found, reason := c.GetWithReason("key3"); !found || reason != NotMissed {
+		t.Errorf("key3 should be found. Got %v", reason)
+	}
+
+	// Only the last 2 departures are remembered.
+	c.Delete("key3")
+	expectMissReason(t, c, "key1", NeverSet)
+
+	// Setting a key again forgets why it left.
+	c.Set("key2", "2")
+	c.Delete("key2")
+	c.Set("key2", "2")
+	if _, found, _ := c.GetWithReason("key2"); !found {
+		t.Errorf("key2 should be found")
+	}
+}
+
+type countingFlusher struct {
+	memFlusher
+	nrAdds    int
+	nrRemoves int
+}
+
+func newCountingFlusher() *countingFlusher {
+	return &countingFlusher{memFlusher: memFlusher{data: make(map[string]interface{})}}
+}
+
+func (f *countingFlusher) Add(key string, value interface{}) {
+	f.memFlusher.Add(key, value)
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.nrAdds++
+}
+
+func (f *countingFlusher) Remove(key string) {
+	f.memFlusher.Remove(key)
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.nrRemoves++
+}
+
+func (f *countingFlusher) adds() int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.nrAdds
+}
+
+func (f *countingFlusher) removes() int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.nrRemoves
+}
+
+func TestFlushDelayCoalescesBursts(t *testing.T) {
+	f := newCountingFlusher()
+	clk := newFakeClock()
+	c := New(10, 2, 0*time.Second, f)
+	c.clock = clk
+	c.SetFlushDelay(time.Second)
+
+	keys := []string{"key1", "key2", "key3", "key4", "key5"}
+	for _, k := range keys {
+		c.Set(k, k)
+	}
+	if n := f.adds(); n != 0 {
+		t.Errorf("flush should wait for the window. Got %v writes", n)
+	}
+
+	clk.Advance(time.Second)
+	if n := c.FlushCount(); n != 1 {
+		t.Errorf("burst should produce a single flush. Got %v", n)
+	}
+	for _, k := range keys {
+		if _, ok := f.threadSafeGet(k); !ok {
+			t.Errorf("%v does not exist", k)
+		}
+	}
+
+	// A steady stream is still flushed once per window.
+	for i := 0; i < 6; i++ {
+		c.Set(keys[i%2], i)
+		clk.Advance(300 * time.Millisecond)
+	}
+	if n := c.FlushCount(); n != 2 {
+		t.Errorf("stream should be flushed within one window. Got %v flushes", n)
+	}
+}
+
+func waitForGoroutines(n int) int {
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return runtime.NumGoroutine()
+}
+
+func TestCloseStopsBackgroundGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	c := New(5, -1, 1*time.Second, newMemFlusher())
+	if n := c.NumBackgroundGoroutines(); n != 1 {
+		t.Errorf("periodic flush should run 1 goroutine. Got %v", n)
+	}
+	s := NewSimple(5)
+	if n := s.NumBackgroundGoroutines(); n != 0 {
+		t.Errorf("SimpleCache should run no goroutine. Got %v", n)
+	}
+
+	c.Close()
+	s.Close()
+	if n := c.NumBackgroundGoroutines(); n != 0 {
+		t.Errorf("Close should stop every goroutine. Got %v", n)
+	}
+	if n := waitForGoroutines(baseline); n > baseline {
+		t.Errorf("%v goroutines left running, started with %v", n, baseline)
+	}
+}
+
+func TestCleanupRunsOnceWhenEntryLeaves(t *testing.T) {
+	cleaned := make(map[string]int)
+	cleanup := func(value interface{}) {
+		cleaned[value.(string)]++
+	}
+
+	c := NewSimple(2)
+	c.SetWithCleanup("key1", "evicted", cleanup)
+	c.SetWithCleanup("key2", "deleted", cleanup)
+	c.SetWithCleanup("key3", "replaced", cleanup)
+	c.Delete("key2")
+	c.Set("key3", "3")
+	c.Set("key3", "33")
+	c.Delete("key3")
+
+	for _, v := range []string{"evicted", "deleted", "replaced"} {
+		if cleaned[v] != 1 {
+			t.Errorf("cleanup of %v should run once. Ran %v times", v, cleaned[v])
+		}
+	}
+	if len(cleaned) != 3 {
+		t.Errorf("only entries set with a cleanup should be cleaned: %v", cleaned)
+	}
+
+	f := newMemFlusher()
+	fc := New(1, -1, 0*time.Second, f)
+	fc.SetWithCleanup("key1", "flushed", cleanup)
+	fc.Set("key2", "2")
+	if cleaned["flushed"] != 1 {
+		t.Errorf("cleanup should run when Cache evicts the entry")
+	}
+}
+
+func TestCleanupMayCallIntoCache(t *testing.T) {
+	c := NewSimple(1)
+	c.SetWithCleanup("key1", "1", func(value interface{}) {
+		c.Set("cleaned", value)
+	})
+	c.Delete("key1")
+	expectCachedValueEquals(t, c, "cleaned", "1")
+}
+
+func TestUpdateSetDoesNotAllocate(t *testing.T) {
+	c := New(5, -1, 0*time.Second, newMemFlusher())
+	var value interface{} = "value"
+	c.Set("key1", value)
+	allocs := testing.AllocsPerRun(100, func() {
+		c.Set("key1", value)
+	})
+	if allocs != 0 {
+		t.Errorf("updating a dirty key made %v allocations", allocs)
+	}
+	if c.dirtyList.Len() != 1 {
+		t.Errorf("updates should share one dirty element. Got %v", c.dirtyList.Len())
+	}
+}
+
+func BenchmarkCacheUpdateSet(b *testing.B) {
+	c := New(1024, -1, 0*time.Second, newMemFlusher())
+	var value interface{} = "value"
+	c.Set("key1", value)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Set("key1", value)
+	}
+}
+
+func TestDrainAll(t *testing.T) {
+	kv := map[string]string{"key1": "1", "key2": "2", "key3": "3"}
+
+	c := NewSimple(5)
+	f := newMemFlusher()
+	fc := New(5, -1, 0*time.Second, f)
+	for k, v := range kv {
+		c.Set(k, v)
+		fc.Set(k, v)
+	}
+
+	for _, drained := range []map[string]interface{}{c.DrainAll(), fc.DrainAll()} {
+		if len(drained) != len(kv) {
+			t.Errorf("should drain %v entries. Got %v", len(kv), drained)
+		}
+		for k, v := range kv {
+			if drained[k] != v {
+				t.Errorf("should be %v on key %v. Got %v", v, k, drained[k])
+			}
+		}
+	}
+	if c.Len() != 0 || fc.Len() != 0 {
+		t.Errorf("drained caches should be empty. Got %v and %v", c.Len(), fc.Len())
+	}
+	for k, v := range kv {
+		if value, _ := f.threadSafeGet(k); value != v {
+			t.Errorf("%v should have been flushed before draining. Got %v", k, value)
+		}
+	}
+	c.Set("key1", "1")
+	expectCachedValueEquals(t, c, "key1", "1")
+}
+
+func TestExtractHottest(t *testing.T) {
+	f := newMemFlusher()
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, f)}
+	for _, c := range caches {
+		for _, k := range []string{"key1", "key2", "key3", "key4", "key5"} {
+			c.Set(k, k)
+		}
+		c.Get("key2")
+		c.Get("key4")
+
+		var hottest []Entry
+		switch c := c.(type) {
+		case *SimpleCache:
+			hottest = c.ExtractHottest(2)
+		case *Cache:
+			hottest = c.ExtractHottest(2)
+		}
+		if len(hottest) != 2 || hottest[0].Key != "key4" || hottest[1].Key != "key2" {
+			t.Errorf("hottest entries should be key4 and key2. Got %v", hottest)
+		}
+		if hottest[0].Value != "key4" {
+			t.Errorf("should be key4 on key key4. Got %v", hottest[0].Value)
+		}
+		if c.Len() != 3 {
+			t.Errorf("hottest entries should be removed. Len is %v", c.Len())
+		}
+		for _, k := range []string{"key2", "key4"} {
+			if v := c.Get(k); v != nil {
+				t.Errorf("Got %v for extracted key %v", v, k)
+			}
+		}
+	}
+
+	caches[1].Flush()
+	if _, ok := f.threadSafeGet("key4"); !ok {
+		t.Errorf("extracted key4 should still be flushed")
+	}
+}
+
+func TestOnBeforeFlush(t *testing.T) {
+	var flushed [][]string
+	c := New(5, 3, 0*time.Second, newMemFlusher())
+	c.SetOnBeforeFlush(func(keys []string) {
+		flushed = append(flushed, keys)
+	})
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Set("key1", "11")
+	c.Delete("key2")
+	c.Set("key3", "3")
+	c.Set("key4", "4")
+	c.Flush()
+
+	expected := [][]string{{"key1", "key2", "key3"}, {"key4"}}
+	if fmt.Sprint(flushed) != fmt.Sprint(expected) {
+		t.Errorf("flushes should process %v. Got %v", expected, flushed)
+	}
+}
+
+func TestOnBeforeFlushRunsUnlocked(t *testing.T) {
+	f := newMemFlusher()
+	c := New(5, -1, 0*time.Second, f)
+	c.SetOnBeforeFlush(func(keys []string) {
+		// These would deadlock if the cache was locked.
+		if v := c.Get("key1"); v != "1" {
+			t.Errorf("should be 1 on key1 during the flush. Got %v", v)
+		}
+		c.Set("key2", "2")
+	})
+	c.Set("key1", "1")
+	c.Flush()
+	if _, ok := f.threadSafeGet("key2"); ok {
+		t.Errorf("key2 set during the flush should be left for the next one")
+	}
+	c.SetOnBeforeFlush(nil)
+	c.Flush()
+	if v, _ := f.threadSafeGet("key2"); v != "2" {
+		t.Errorf("key2 should be flushed next. Got %v", v)
+	}
+}
+
+func TestConcurrentSetAndFlush(t *testing.T) {
+	f := newMemFlusher()
+	c := New(-1, 16, 0*time.Second, f)
+	c.SetFlushDelay(time.Millisecond)
+	keys := []string{"key1", "key2", "key3", "key4", "key5"}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				c.Flush()
+			}
+		}
+	}()
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := keys[(g+i)%len(keys)]
+				if i%7 == 0 {
+					c.Delete(k)
+				} else {
+					c.Set(k, fmt.Sprintf("%v-%v", g, i))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(done)
+	c.Close()
+	c.Flush()
+
+	for _, k := range keys {
+		expected := c.Get(k)
+		value, ok := f.threadSafeGet(k)
+		if expected == nil && ok {
+			t.Errorf("%v was deleted, but the flusher has %v", k, value)
+		} else if expected != nil && value != expected {
+			t.Errorf("flusher should have %v on key %v. Got %v", expected, k, value)
+		}
+	}
+}
+
+func TestSizeReporter(t *testing.T) {
+	var sizes []int
+	c := NewSimple(4)
+	c.SetSizeReporter(3, func(size int) {
+		sizes = append(sizes, size)
+	})
+	for i := 0; i < 9; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	if len(sizes) != 3 {
+		t.Fatalf("reporter should fire 3 times. Got %v", sizes)
+	}
+	if sizes[0] != 3 || sizes[1] != 4 || sizes[2] != 4 {
+		t.Errorf("reported sizes should be [3 4 4]. Got %v", sizes)
+	}
+
+	f := newMemFlusher()
+	fc := New(5, -1, 0*time.Second, f)
+	sizes = nil
+	fc.SetSizeReporter(2, func(size int) {
+		sizes = append(sizes, size)
+		fc.Len()
+	})
+	fc.Set("key1", "1")
+	fc.Set("key2", "2")
+	fc.Delete("key1")
+	fc.Delete("key2")
+	if len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 0 {
+		t.Errorf("reported sizes should be [2 0]. Got %v", sizes)
+	}
+}
+
+func TestOrderingSnapshot(t *testing.T) {
+	clk := newFakeClock()
+	c := New(5, -1, 0*time.Second, newMemFlusher())
+	c.clock = clk
+	c.Set("key1", "1")
+	clk.Advance(time.Minute)
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+	c.Flush()
+	c.Get("key1")
+	c.Get("key1")
+	c.Get("key2")
+	c.Set("key3", "33")
+	clk.Advance(time.Minute)
+
+	expected := []KeyMeta{
+		{Key: "key3", Age: time.Minute, AccessCount: 0, Dirty: true},
+		{Key: "key2", Age: time.Minute, AccessCount: 1, Dirty: false},
+		{Key: "key1", Age: 2 * time.Minute, AccessCount: 2, Dirty: false},
+	}
+	snapshot := c.OrderingSnapshot()
+	if len(snapshot) != len(expected) {
+		t.Fatalf("snapshot should be %v. Got %v", expected, snapshot)
+	}
+	for i := range expected {
+		if snapshot[i] != expected[i] {
+			t.Errorf("entry %v should be %+v. Got %+v", i, expected[i], snapshot[i])
+		}
+	}
+}
+
+func accessCount(c *SimpleCache, key string) uint64 {
+	for _, m := range c.OrderingSnapshot() {
+		if m.Key == key {
+			return m.AccessCount
+		}
+	}
+	return 0
+}
+
+func TestAccessCountAging(t *testing.T) {
+	clk := newFakeClock()
+	c := NewSimple(5)
+	c.clock = clk
+	c.SetAccessCountAging(time.Minute)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	for i := 0; i < 8; i++ {
+		c.Get("key1")
+	}
+	if n := accessCount(c, "key1"); n != 8 {
+		t.Errorf("key1 should have 8 accesses. Got %v", n)
+	}
+
+	clk.Advance(3*time.Minute + time.Second)
+	if n := accessCount(c, "key1"); n != 1 {
+		t.Errorf("key1 should decay to 1 after 3 intervals. Got %v", n)
+	}
+	for i := 0; i < 3; i++ {
+		c.Get("key2")
+	}
+	if old, hot := accessCount(c, "key1"), accessCount(c, "key2"); hot <= old {
+		t.Errorf("newly hot key2 (%v) should overtake key1 (%v)", hot, old)
+	}
+
+	clk.Advance(time.Hour * 24 * 365)
+	if n := accessCount(c, "key2"); n != 0 {
+		t.Errorf("key2 should decay to 0. Got %v", n)
+	}
+}
+
+func TestCloseFlushesAndIsIdempotent(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	f := newMemFlusher()
+	c := New(5, -1, 1*time.Second, f)
+	c.SetFlushDelay(time.Hour)
+	c.Set("key1", "1")
+
+	c.Close()
+	if _, ok := f.threadSafeGet("key1"); !ok {
+		t.Errorf("Close should flush pending modifications")
+	}
+	if n := waitForGoroutines(baseline); n > baseline {
+		t.Errorf("%v goroutines left running, started with %v", n, baseline)
+	}
+	c.Close()
+
+	// After Close, reaching maxNrDirty flushes synchronously.
+	c.maxNrDirty = 1
+	c.Set("key2", "2")
+	if _, ok := f.threadSafeGet("key2"); !ok {
+		t.Errorf("key2 should be flushed without a delay after Close")
+	}
+	expectCachedValueEquals(t, c, "key2", "2")
+}
+
+func TestEvictedEntriesAreFlushed(t *testing.T) {
+	f := newMemFlusher()
+	c := New(2, -1, 0*time.Second, f)
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i%5), i)
+	}
+	if c.Len() != 2 {
+		t.Errorf("cache should hold 2 entries. Got %v", c.Len())
+	}
+	c.Flush()
+	for i := 5; i < 10; i++ {
+		if v, _ := f.threadSafeGet(strconv.Itoa(i % 5)); v != i {
+			t.Errorf("flusher should have %v on evicted key %v. Got %v", i, i%5, v)
+		}
+	}
+}
+
+func TestGetOKTellsNilFromMiss(t *testing.T) {
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		c.Set("tombstone", nil)
+		var getOK func(string) (interface{}, bool)
+		switch c := c.(type) {
+		case *SimpleCache:
+			getOK = c.GetOK
+		case *Cache:
+			getOK = c.GetOK
+		}
+		if v, ok := getOK("tombstone"); !ok || v != nil {
+			t.Errorf("stored nil should be found as nil. Got %v, %v", v, ok)
+		}
+		if v, ok := getOK("notexist"); ok || v != nil {
+			t.Errorf("absent key should not be found. Got %v, %v", v, ok)
+		}
+	}
+}
+
+func TestSetWithExpiry(t *testing.T) {
+	f := newMemFlusher()
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, f)}
+	for _, c := range caches {
+		clk := newFakeClock()
+		var setWithExpiry func(string, interface{}, time.Duration)
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.clock = clk
+			setWithExpiry = c.SetWithExpiry
+		case *Cache:
+			c.clock = clk
+			setWithExpiry = c.SetWithExpiry
+		}
+		setWithExpiry("session", "token", 15*time.Minute)
+		setWithExpiry("forever", "1", 0)
+		c.Set("plain", "2")
+
+		clk.Advance(14 * time.Minute)
+		expectCachedValueEquals(t, c, "session", "token")
+
+		clk.Advance(time.Minute)
+		if v := c.Get("session"); v != nil {
+			t.Errorf("session should have expired. Got %v", v)
+		}
+		if c.Len() != 2 {
+			t.Errorf("expired entry should be removed. Got %v entries", c.Len())
+		}
+		expectCachedValueEquals(t, c, "forever", "1")
+		expectCachedValueEquals(t, c, "plain", "2")
+
+		// Set replaces the entry with one that never expires.
+		setWithExpiry("session", "token", time.Minute)
+		c.Set("session", "token2")
+		clk.Advance(time.Hour)
+		expectCachedValueEquals(t, c, "session", "token2")
+	}
+
+	// Expiry is not a deletion: the flusher keeps the value.
+	c := caches[1].(*Cache)
+	c.SetWithExpiry("written", "3", time.Second)
+	c.clock.(*fakeClock).Advance(time.Second)
+	c.Get("written")
+	c.Flush()
+	if v, _ := f.threadSafeGet("written"); v != "3" {
+		t.Errorf("flusher should have written. Got %v", v)
+	}
+}
+
+func TestExpiredMissReason(t *testing.T) {
+	clk := newFakeClock()
+	c := NewSimple(5)
+	c.clock = clk
+	c.TrackMissReasons(5)
+	c.SetWithExpiry("key1", "1", time.Second)
+	clk.Advance(time.Second)
+	expectMissReason(t, c, "key1", Expired)
+}
+
+func TestOnEvict(t *testing.T) {
+	caches := []CacheInterface{NewSimple(2), New(2, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		var evicted []Entry
+		onEvict := func(key string, value interface{}) {
+			// The cache must not be locked.
+			c.Get(key)
+			evicted = append(evicted, Entry{key, value})
+		}
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.SetOnEvict(onEvict)
+		case *Cache:
+			c.SetOnEvict(onEvict)
+		}
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		c.Get("key1")
+		c.Set("key3", "3")
+		c.Delete("key1")
+		if len(evicted) != 1 || evicted[0] != (Entry{"key2", "2"}) {
+			t.Errorf("only key2 should be evicted. Got %v", evicted)
+		}
+	}
+}
+
+func TestConcurrentGetKeepsRecency(t *testing.T) {
+	c := NewSimple(100)
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i), strconv.Itoa(i))
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Get(strconv.Itoa(i % 50))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Keys 50 to 99 were never read, so they are evicted first.
+	for i := 100; i < 150; i++ {
+		c.Set(strconv.Itoa(i), strconv.Itoa(i))
+	}
+	for i := 0; i < 50; i++ {
+		expectCachedValueEquals(t, c, strconv.Itoa(i), strconv.Itoa(i))
+	}
+	for i := 50; i < 100; i++ {
+		if v := c.Get(strconv.Itoa(i)); v != nil {
+			t.Errorf("key %v should be evicted. Got %v", i, v)
+		}
+	}
+	if hits := c.Stats().Hits; hits != 4000+50 {
+		t.Errorf("every Get should count. Got %v hits", hits)
+	}
+}
+
+func BenchmarkSimpleCacheGetParallel(b *testing.B) {
+	keys := benchmarkKeys(1024)
+	c := NewSimple(len(keys))
+	for _, k := range keys {
+		c.Set(k, k)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			c.Get(keys[i%len(keys)])
+		}
+	})
+}
+
+func TestClear(t *testing.T) {
+	f := newMemFlusher()
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, f)}
+	for _, c := range caches {
+		for i := 0; i < 5; i++ {
+			c.Set(strconv.Itoa(i), i)
+		}
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.Clear()
+		case *Cache:
+			c.Clear()
+		}
+		if c.Len() != 0 {
+			t.Errorf("cache should be empty. Got %v entries", c.Len())
+		}
+		for i := 0; i < 5; i++ {
+			if v := c.Get(strconv.Itoa(i)); v != nil {
+				t.Errorf("key %v should be cleared. Got %v", i, v)
+			}
+		}
+		c.Set("key1", "1")
+		expectCachedValueEquals(t, c, "key1", "1")
+	}
+	for i := 0; i < 5; i++ {
+		if v, _ := f.threadSafeGet(strconv.Itoa(i)); v != i {
+			t.Errorf("flusher should have %v on key %v. Got %v", i, i, v)
+		}
+	}
+}
+
+func TestPeekDoesNotPromote(t *testing.T) {
+	caches := []CacheInterface{NewSimple(3), New(3, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		var peek func(string) (interface{}, bool)
+		switch c := c.(type) {
+		case *SimpleCache:
+			peek = c.Peek
+		case *Cache:
+			peek = c.Peek
+		}
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		c.Set("key3", "3")
+		for i := 0; i < 3; i++ {
+			if v, ok := peek("key1"); !ok || v != "1" {
+				t.Errorf("should peek 1 on key1. Got %v, %v", v, ok)
+			}
+		}
+		if _, ok := peek("notexist"); ok {
+			t.Errorf("Got nonexist")
+		}
+		c.Set("key4", "4")
+		if _, ok := peek("key1"); ok {
+			t.Errorf("peeked key1 should still be evicted")
+		}
+		expectCachedValueEquals(t, c, "key2", "2")
+	}
+}
+
+func TestDeleteAbsentKeyIsNotDirty(t *testing.T) {
+	f := newCountingFlusher()
+	c := New(1, -1, 0*time.Second, f)
+	c.Set("key1", "1")
+	n := c.dirtyList.Len()
+	if v := c.Delete("notexist"); v != nil {
+		t.Errorf("Got %v deleting nonexist", v)
+	}
+	if c.dirtyList.Len() != n {
+		t.Errorf("deleting an absent key should not dirty the cache. Got %v dirty, expected %v", c.dirtyList.Len(), n)
+	}
+
+	// An evicted key waiting to be flushed is still removed.
+	c.Set("key2", "2")
+	c.Delete("key1")
+	c.Flush()
+	if n := f.removes(); n != 1 {
+		t.Errorf("flusher should remove key1 only. Got %v removes", n)
+	}
+	if _, ok := f.threadSafeGet("key1"); ok {
+		t.Errorf("key1 should be removed from the flusher")
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	sizer := func(value interface{}) int { return len(value.(string)) }
+	caches := []CacheInterface{NewSimple(-1), New(-1, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		var size func() int
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.SetMaxSize(10, sizer)
+			size = c.Size
+		case *Cache:
+			c.SetMaxSize(10, sizer)
+			size = c.Size
+		}
+		c.Set("key1", "aaaa")
+		c.Set("key2", "bbbb")
+		if n := size(); n != 8 {
+			t.Errorf("size should be 8. Got %v", n)
+		}
+		c.Get("key1")
+
+		// 12 bytes do not fit, so the least recently used entry goes.
+		c.Set("key3", "cccc")
+		if c.Len() != 2 || size() != 8 {
+			t.Errorf("cache should hold 2 entries of 8 bytes. Got %v of %v", c.Len(), size())
+		}
+		if v := c.Get("key2"); v != nil {
+			t.Errorf("key2 should be evicted. Got %v", v)
+		}
+
+		// One large value can push out several small ones.
+		c.Set("key4", "dddddddd")
+		if c.Len() != 1 || size() != 8 {
+			t.Errorf("cache should hold 1 entry of 8 bytes. Got %v of %v", c.Len(), size())
+		}
+		c.Set("key4", "dd")
+		c.Delete("key4")
+		if size() != 0 {
+			t.Errorf("size should drop to 0. Got %v", size())
+		}
+	}
+}
+
+func TestGetOrComputeRunsOnce(t *testing.T) {
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		var getOrCompute func(string, func() interface{}) interface{}
+		switch c := c.(type) {
+		case *SimpleCache:
+			getOrCompute = c.GetOrCompute
+		case *Cache:
+			getOrCompute = c.GetOrCompute
+		}
+		var m sync.Mutex
+		nrComputes := 0
+		release := make(chan struct{})
+		compute := func() interface{} {
+			m.Lock()
+			nrComputes++
+			m.Unlock()
+			<-release
+			return "value"
+		}
+
+		var wg sync.WaitGroup
+		values := make([]interface{}, 20)
+		for i := range values {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				values[i] = getOrCompute("key1", compute)
+			}(i)
+		}
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		if nrComputes != 1 {
+			t.Errorf("compute should run once. Got %v", nrComputes)
+		}
+		for _, v := range values {
+			if v != "value" {
+				t.Errorf("every caller should get the computed value. Got %v", v)
+			}
+		}
+		expectCachedValueEquals(t, c, "key1", "value")
+		if v := getOrCompute("key1", func() interface{} { return "other" }); v != "value" {
+			t.Errorf("cached value should be returned. Got %v", v)
+		}
+	}
+}
+
+func TestBatchMatchesSingleCalls(t *testing.T) {
+	batched := []CacheInterface{NewSimple(3), New(3, -1, 0*time.Second, newMemFlusher())}
+	single := []CacheInterface{NewSimple(3), New(3, -1, 0*time.Second, newMemFlusher())}
+	entries := map[string]interface{}{"key1": "1", "key2": "2"}
+	for i, c := range batched {
+		s := single[i]
+		var getMany func([]string) map[string]interface{}
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.SetMany(entries)
+			getMany = c.GetMany
+		case *Cache:
+			c.SetMany(entries)
+			getMany = c.GetMany
+		}
+		for k, v := range entries {
+			s.Set(k, v)
+		}
+
+		values := getMany([]string{"key2", "key1", "notexist"})
+		if len(values) != 2 || values["key1"] != "1" || values["key2"] != "2" {
+			t.Errorf("should get key1 and key2. Got %v", values)
+		}
+		s.Get("key2")
+		s.Get("key1")
+		s.Get("notexist")
+
+		// key2 was read before key1, so it is evicted first.
+		for _, c := range []CacheInterface{c, s} {
+			c.Set("key3", "3")
+			c.Set("key4", "4")
+			if v := c.Get("key2"); v != nil {
+				t.Errorf("key2 should be evicted. Got %v", v)
+			}
+			expectCachedValueEquals(t, c, "key1", "1")
+		}
+	}
+
+	f := newCountingFlusher()
+	c := New(5, 3, 0*time.Second, f)
+	c.SetMany(map[string]interface{}{"key1": "1", "key2": "2", "key3": "3", "key4": "4"})
+	if c.dirtyList.Len() != 0 || f.adds() != 4 {
+		t.Errorf("batch should be flushed at once. Got %v dirty, %v written", c.dirtyList.Len(), f.adds())
+	}
+}
+
+// peakPolicy is a FIFO policy that records the most keys it ever tracked.
+type peakPolicy struct {
+	EvictionPolicy
+	tracked, peak int
+}
+
+func (p *peakPolicy) RecordInsert(key string) {
+	p.EvictionPolicy.RecordInsert(key)
+	if p.tracked++; p.tracked > p.peak {
+		p.peak = p.tracked
+	}
+}
+
+func (p *peakPolicy) RecordRemove(key string) {
+	p.EvictionPolicy.RecordRemove(key)
+	p.tracked--
+}
+
+func (p *peakPolicy) Evict() string {
+	p.tracked--
+	return p.EvictionPolicy.Evict()
+}
+
+func TestSetManyStaysWithinCapacity(t *testing.T) {
+	entries := benchmarkEntries(10)
+	for _, c := range []CacheInterface{NewSimple(3), New(3, -1, 0*time.Second, newMemFlusher())} {
+		p := &peakPolicy{EvictionPolicy: NewFIFOPolicy()}
+		evicted := 0
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.SetEvictionPolicy(p)
+			c.SetOnEvict(func(key string, value interface{}) { evicted++ })
+			c.SetMany(entries)
+		case *Cache:
+			c.SetEvictionPolicy(p)
+			c.SetOnEvict(func(key string, value interface{}) { evicted++ })
+			c.SetMany(entries)
+		}
+		// Like Set, each insert may go one over capacity before evicting.
+		if p.peak != 4 {
+			t.Errorf("the cache should evict after each insert. Held %v entries", p.peak)
+		}
+		if c.Len() != 3 || evicted != 7 {
+			t.Errorf("should keep 3 entries and evict 7. Got %v kept, %v evicted", c.Len(), evicted)
+		}
+	}
+}
+
+func benchmarkEntries(n int) map[string]interface{} {
+	entries := make(map[string]interface{}, n)
+	for _, k := range benchmarkKeys(n) {
+		entries[k] = k
+	}
+	return entries
+}
+
+func BenchmarkSimpleCacheSetMany(b *testing.B) {
+	entries := benchmarkEntries(1024)
+	c := NewSimple(len(entries))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.SetMany(entries)
+	}
+}
+
+func BenchmarkSimpleCacheSetLoop(b *testing.B) {
+	entries := benchmarkEntries(1024)
+	c := NewSimple(len(entries))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for k, v := range entries {
+			c.Set(k, v)
+		}
+	}
+}
+
+// cancellingFlusher cancels its context once it has written n entries.
+type cancellingFlusher struct {
+	memFlusher
+	n      int
+	cancel context.CancelFunc
+}
+
+func (f *cancellingFlusher) Add(key string, value interface{}) error {
+	return f.AddContext(context.Background(), key, value)
+}
+
+func (f *cancellingFlusher) Remove(key string) error {
+	return f.RemoveContext(context.Background(), key)
+}
+
+func (f *cancellingFlusher) AddContext(ctx context.Context, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.memFlusher.Add(key, value)
+	if f.n--; f.n == 0 {
+		f.cancel()
+	}
+	return nil
+}
+
+func (f *cancellingFlusher) RemoveContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.memFlusher.Remove(key)
+	return nil
+}
+
+func TestFlushContextStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &cancellingFlusher{memFlusher: *newMemFlusher(), n: 2, cancel: cancel}
+	c := NewWithErrorFlusher(10, -1, 0*time.Second, f)
+	for i := 0; i < 5; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	if err := c.FlushContext(ctx); err != context.Canceled {
+		t.Errorf("FlushContext should return %v. Got %v", context.Canceled, err)
+	}
+	if n := len(f.data); n != 2 {
+		t.Errorf("flush should stop after 2 writes. Got %v", n)
+	}
+	if n := c.dirtyList.Len(); n != 3 {
+		t.Errorf("unwritten entries should stay dirty. Got %v dirty", n)
+	}
+
+	if err := c.FlushContext(context.Background()); err != nil {
+		t.Errorf("flush should succeed. Got %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if v, _ := f.threadSafeGet(strconv.Itoa(i)); v != i {
+			t.Errorf("flusher should have %v on key %v. Got %v", i, i, v)
+		}
+	}
+}
+
+// blockingFlusher blocks every Add until release is closed, signalling
+// on entered first.
+type blockingFlusher struct {
+	memFlusher
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingFlusher) Add(key string, value interface{}) {
+	f.entered <- struct{}{}
+	<-f.release
+	f.memFlusher.Add(key, value)
+}
+
+func TestFlushDoesNotBlockAccess(t *testing.T) {
+	f := &blockingFlusher{
+		memFlusher: *newMemFlusher(),
+		entered:    make(chan struct{}, 10),
+		release:    make(chan struct{}),
+	}
+	c := New(10, -1, 0*time.Second, f)
+	c.Set("key1", "1")
+	flushed := make(chan struct{})
+	go func() {
+		c.Flush()
+		close(flushed)
+	}()
+	<-f.entered
+
+	accessed := make(chan struct{})
+	go func() {
+		c.Get("key1")
+		c.Set("key1", "2")
+		c.Set("key2", "2")
+		close(accessed)
+	}()
+	select {
+	case <-accessed:
+	case <-time.After(time.Second):
+		t.Fatalf("Get and Set should not wait for the flusher")
+	}
+	close(f.release)
+	<-flushed
+
+	// The writes made during the flush are still dirty.
+	if n := c.dirtyList.Len(); n != 2 {
+		t.Errorf("modifications made during the flush should stay dirty. Got %v", n)
+	}
+	c.Flush()
+	for _, k := range []string{"key1", "key2"} {
+		if v, _ := f.threadSafeGet(k); v != "2" {
+			t.Errorf("flusher should have 2 on %v. Got %v", k, v)
+		}
+	}
+}
+
+func TestDeleteDuringFlushIsRecorded(t *testing.T) {
+	f := &blockingFlusher{
+		memFlusher: *newMemFlusher(),
+		entered:    make(chan struct{}, 10),
+		release:    make(chan struct{}),
+	}
+	c := New(1, -1, 0*time.Second, f)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	flushed := make(chan struct{})
+	go func() {
+		c.Flush()
+		close(flushed)
+	}()
+	<-f.entered
+
+	// key1 is evicted and its Set is being written.
+	c.Delete("key1")
+	close(f.release)
+	<-flushed
+	c.Flush()
+	if _, ok := f.threadSafeGet("key1"); ok {
+		t.Errorf("Delete made during the flush should reach the flusher")
+	}
+}
+
+func TestFlushWaitsForOneFlushAfterIt(t *testing.T) {
+	f := &blockingFlusher{
+		memFlusher: *newMemFlusher(),
+		entered:    make(chan struct{}, 10),
+		release:    make(chan struct{}),
+	}
+	c := New(5, -1, 0*time.Second, f)
+	c.Set("key1", "1")
+	first := make(chan struct{})
+	go func() {
+		c.Flush()
+		close(first)
+	}()
+	<-f.entered
+
+	second := make(chan struct{})
+	go func() {
+		c.Flush()
+		close(second)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for waiting := false; !waiting && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		c.mu.RLock()
+		waiting = c.flushWait != nil
+		c.mu.RUnlock()
+	}
+	c.Set("key2", "2")
+
+	// The first Flush is done once its flush is; the second runs the
+	// flush of key2 the first one no longer waits for.
+	f.release <- struct{}{}
+	select {
+	case <-first:
+	case <-time.After(time.Second):
+		t.Fatalf("the first Flush should not wait for the flush after it")
+	}
+	<-f.entered
+	select {
+	case <-second:
+		t.Errorf("the second Flush should wait for the flush of key2")
+	default:
+	}
+	f.release <- struct{}{}
+	<-second
+	if v, _ := f.threadSafeGet("key2"); v != "2" {
+		t.Errorf("flusher should have 2 on key2. Got %v", v)
+	}
+}
+
+func TestContains(t *testing.T) {
+	caches := []CacheInterface{NewSimple(2), New(2, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		var contains func(string) bool
+		switch c := c.(type) {
+		case *SimpleCache:
+			contains = c.Contains
+		case *Cache:
+			contains = c.Contains
+		}
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		for i := 0; i < 3; i++ {
+			if !contains("key1") {
+				t.Errorf("key1 should be contained")
+			}
+		}
+		if contains("notexist") {
+			t.Errorf("notexist should not be contained")
+		}
+		c.Set("key3", "3")
+		if contains("key1") {
+			t.Errorf("Contains should not keep key1 from eviction")
+		}
+		// A removal pending in the dirty list does not count as cached.
+		c.Delete("key2")
+		if contains("key2") {
+			t.Errorf("deleted key2 should not be contained")
+		}
+	}
+	if n := testing.AllocsPerRun(100, func() { caches[0].(*SimpleCache).Contains("key2") }); n != 0 {
+		t.Errorf("Contains should not allocate. Got %v allocations", n)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	f := newCountingFlusher()
+	pairs := [][2]CacheInterface{
+		{NewSimple(3), NewSimple(3)},
+		{New(3, -1, 0*time.Second, f), New(3, -1, 0*time.Second, f)},
+	}
+	for _, pair := range pairs {
+		c, restored := pair[0], pair[1]
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		c.Set("key3", "3")
+		c.Get("key1")
+
+		var snapshot []Entry
+		switch c := c.(type) {
+		case *SimpleCache:
+			snapshot = c.Snapshot()
+			restored.(*SimpleCache).Restore(snapshot)
+		case *Cache:
+			c.Flush()
+			snapshot = c.Snapshot()
+			restored.(*Cache).Restore(snapshot)
+		}
+		expected := []Entry{{"key1", "1"}, {"key3", "3"}, {"key2", "2"}}
+		if fmt.Sprint(snapshot) != fmt.Sprint(expected) {
+			t.Errorf("snapshot should be %v. Got %v", expected, snapshot)
+		}
+
+		var order []Entry
+		switch restored := restored.(type) {
+		case *SimpleCache:
+			order = restored.Snapshot()
+		case *Cache:
+			order = restored.Snapshot()
+			if n := restored.dirtyList.Len(); n != 0 {
+				t.Errorf("restored entries should not be dirty. Got %v", n)
+			}
+		}
+		if fmt.Sprint(order) != fmt.Sprint(expected) {
+			t.Errorf("restored order should be %v. Got %v", expected, order)
+		}
+
+		// key2 is still the least recently used.
+		restored.Set("key4", "4")
+		if v := restored.Get("key2"); v != nil {
+			t.Errorf("key2 should be evicted. Got %v", v)
+		}
+	}
+}
+
+func TestZeroCapacityCachesNothing(t *testing.T) {
+	f := newMemFlusher()
+	caches := []CacheInterface{NewSimple(0), New(0, 1, 0*time.Second, f)}
+	for _, c := range caches {
+		cleanups := 0
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.SetWithCleanup("key1", "1", func(interface{}) { cleanups++ })
+		case *Cache:
+			c.SetWithCleanup("key1", "1", func(interface{}) { cleanups++ })
+		}
+		c.Set("key2", "2")
+		if c.Len() != 0 {
+			t.Errorf("capacity 0 should store nothing. Got %v entries", c.Len())
+		}
+		if v := c.Get("key2"); v != nil {
+			t.Errorf("Get should always miss. Got %v", v)
+		}
+		if cleanups != 1 {
+			t.Errorf("cleanup should run at once. Ran %v times", cleanups)
+		}
+	}
+	c := caches[1].(*Cache)
+	if n := c.EvictionCount(); n != 0 {
+		t.Errorf("nothing should be evicted. Got %v evictions", n)
+	}
+	for k, v := range map[string]string{"key1": "1", "key2": "2"} {
+		if got, _ := f.threadSafeGet(k); got != v {
+			t.Errorf("writes should still reach the flusher. Got %v on %v", got, k)
+		}
+	}
+}
+
+func TestUpdateIfPresent(t *testing.T) {
+	f := newMemFlusher()
+	caches := []CacheInterface{NewSimple(2), New(2, -1, 0*time.Second, f)}
+	for _, c := range caches {
+		var update func(string, interface{}) bool
+		switch c := c.(type) {
+		case *SimpleCache:
+			update = c.UpdateIfPresent
+		case *Cache:
+			update = c.UpdateIfPresent
+		}
+		if update("key1", "1") {
+			t.Errorf("absent key should not be updated")
+		}
+		if c.Len() != 0 {
+			t.Errorf("absent key should not be inserted. Got %v entries", c.Len())
+		}
+
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		if !update("key1", "11") {
+			t.Errorf("present key should be updated")
+		}
+		expectCachedValueEquals(t, c, "key1", "11")
+
+		// The update made key1 the most recently used.
+		c.Set("key3", "3")
+		if v := c.Get("key2"); v != nil {
+			t.Errorf("key2 should be evicted. Got %v", v)
+		}
+	}
+	caches[1].Flush()
+	if v, _ := f.threadSafeGet("key1"); v != "11" {
+		t.Errorf("update should be flushed. Got %v", v)
+	}
+}
+
+func TestFlushJitter(t *testing.T) {
+	c := New(5, -1, 0*time.Second, newMemFlusher())
+	c.flushPeriod = 10 * time.Second
+	if d := c.flushInterval(); d != c.flushPeriod {
+		t.Errorf("no jitter by default. Got %v", d)
+	}
+
+	c.SetFlushJitter(0.1)
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := c.flushInterval()
+		if d < 9*time.Second || d > 11*time.Second {
+			t.Errorf("interval should be within 10%% of 10s. Got %v", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("interval should vary. Got %v", seen)
+	}
+
+	c.SetFlushJitter(math.NaN())
+	if d := c.flushInterval(); d != c.flushPeriod {
+		t.Errorf("NaN should mean no jitter. Got %v", d)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	f := newMemFlusher()
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, f)}
+	for _, c := range caches {
+		var swap func(string, interface{}) (interface{}, bool)
+		switch c := c.(type) {
+		case *SimpleCache:
+			swap = c.Swap
+		case *Cache:
+			swap = c.Swap
+		}
+		if old, existed := swap("key1", "1"); existed || old != nil {
+			t.Errorf("fresh insert should replace nothing. Got %v, %v", old, existed)
+		}
+		if old, existed := swap("key1", "11"); !existed || old != "1" {
+			t.Errorf("overwrite should return 1. Got %v, %v", old, existed)
+		}
+		expectCachedValueEquals(t, c, "key1", "11")
+	}
+	caches[1].Flush()
+	if v, _ := f.threadSafeGet("key1"); v != "11" {
+		t.Errorf("new value should be flushed. Got %v", v)
+	}
+}
+
+func TestRange(t *testing.T) {
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		var rangeFunc func(func(string, interface{}) bool)
+		switch c := c.(type) {
+		case *SimpleCache:
+			rangeFunc = c.Range
+		case *Cache:
+			rangeFunc = c.Range
+		}
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		c.Set("key3", "3")
+		c.Get("key1")
+
+		var visited []Entry
+		rangeFunc(func(key string, value interface{}) bool {
+			visited = append(visited, Entry{key, value})
+			return true
+		})
+		expected := []Entry{{"key1", "1"}, {"key3", "3"}, {"key2", "2"}}
+		if fmt.Sprint(visited) != fmt.Sprint(expected) {
+			t.Errorf("should visit %v. Got %v", expected, visited)
+		}
+
+		n := 0
+		rangeFunc(func(string, interface{}) bool {
+			n++
+			return n < 2
+		})
+		if n != 2 {
+			t.Errorf("returning false should stop the iteration. Got %v calls", n)
+		}
+	}
+}
+
+func TestNegativeCapacityNeverEvicts(t *testing.T) {
+	caches := []CacheInterface{NewSimple(-1), New(-1, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		for i := 0; i < 2000; i++ {
+			c.Set(strconv.Itoa(i), i)
+		}
+		if c.Len() != 2000 {
+			t.Errorf("cache should hold 2000 entries. Got %v", c.Len())
+		}
+		if v := c.Get("0"); v != 0 {
+			t.Errorf("should be 0 on key 0. Got %v", v)
+		}
+	}
+}
+
+func TestNewWithError(t *testing.T) {
+	if _, err := NewWithError(5, -1, 0, nil); err != ErrNilFlusher {
+		t.Errorf("nil flusher should fail with %v. Got %v", ErrNilFlusher, err)
+	}
+	for _, period := range []time.Duration{-time.Second, 500 * time.Millisecond} {
+		if _, err := NewWithError(5, -1, period, newMemFlusher()); err != ErrFlushPeriod {
+			t.Errorf("flushPeriod %v should fail with %v. Got %v", period, ErrFlushPeriod, err)
+		}
+	}
+	c, err := NewWithError(5, -1, time.Second, newMemFlusher())
+	if err != nil {
+		t.Fatalf("valid arguments should not fail. Got %v", err)
+	}
+	defer c.Close()
+	if n := c.NumBackgroundGoroutines(); n != 1 {
+		t.Errorf("cache should flush periodically. Got %v goroutines", n)
+	}
+}
+
+func TestNewSkipsShortFlushPeriods(t *testing.T) {
+	for _, period := range []time.Duration{-time.Second, 500 * time.Millisecond} {
+		c := New(5, -1, period, newMemFlusher())
+		if n := c.NumBackgroundGoroutines(); n != 0 {
+			t.Errorf("flushPeriod %v should not flush periodically. Got %v goroutines", period, n)
+		}
+		c.Set("key1", "1")
+		expectCachedValueEquals(t, c, "key1", "1")
+		c.Close()
+	}
+}
+
+func TestFlushKey(t *testing.T) {
+	f := newMemFlusher()
+	c := New(5, -1, 0*time.Second, f)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+	c.Delete("key2")
+	c.Set("key2", "22")
+	if flushed, err := c.FlushKey("key2"); !flushed || err != nil {
+		t.Errorf("FlushKey should flush key2. Got %v, %v", flushed, err)
+	}
+	if v, _ := f.threadSafeGet("key2"); v != "22" {
+		t.Errorf("flusher should have 22 on key2. Got %v", v)
+	}
+	for _, k := range []string{"key1", "key3"} {
+		if _, ok := f.threadSafeGet(k); ok {
+			t.Errorf("%v should not be flushed yet", k)
+		}
+	}
+	if n := c.dirtyList.Len(); n != 2 {
+		t.Errorf("other keys should stay dirty. Got %v dirty", n)
+	}
+	if flushed, err := c.FlushKey("notexist"); flushed || err != nil {
+		t.Errorf("FlushKey of an absent key should do nothing. Got %v, %v", flushed, err)
+	}
+	if flushed, err := c.FlushKey("key2"); flushed || err != nil {
+		t.Errorf("FlushKey of a clean key should do nothing. Got %v, %v", flushed, err)
+	}
+
+	failing := NewWithErrorFlusher(5, -1, 0*time.Second, &failingFlusher{newMemFlusher(), map[string]bool{"key1": true}})
+	failing.Set("key1", "1")
+	if flushed, err := failing.FlushKey("key1"); flushed || err == nil {
+		t.Errorf("FlushKey should report the failed write. Got %v, %v", flushed, err)
+	}
+	if n := failing.dirtyList.Len(); n != 1 {
+		t.Errorf("failed key should stay dirty. Got %v dirty", n)
+	}
+}
+
+func TestDirtyListHoldsOneElementPerKey(t *testing.T) {
+	f := newCountingFlusher()
+	c := New(10, -1, 0*time.Second, f)
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i%3), i)
+	}
+	c.Delete("1")
+	c.Set("2", "last")
+	if n := c.dirtyList.Len(); n != 3 {
+		t.Errorf("dirty list should hold one element per key. Got %v", n)
+	}
+	c.Flush()
+	if f.adds() != 2 || f.removes() != 1 {
+		t.Errorf("each key should be written once. Got %v adds and %v removes", f.adds(), f.removes())
+	}
+	if v, _ := f.threadSafeGet("0"); v != 99 {
+		t.Errorf("latest value should be flushed. Got %v", v)
+	}
+	if v, _ := f.threadSafeGet("2"); v != "last" {
+		t.Errorf("latest value should be flushed. Got %v", v)
+	}
+}
+
+func TestDeleteNeverStoredKeyNeverReachesFlusher(t *testing.T) {
+	f := newCountingFlusher()
+	c := New(5, 1, 0*time.Second, f)
+	c.Set("key1", "1")
+	c.Flush()
+	for i := 0; i < 10; i++ {
+		c.Delete("notexist" + strconv.Itoa(i))
+	}
+	c.Flush()
+	if n := f.removes(); n != 0 {
+		t.Errorf("flusher should not be asked to remove keys it never stored. Got %v removes", n)
+	}
+}
+
+func TestDeleteFlushedAndEvictedKey(t *testing.T) {
+	f := newMemFlusher()
+	c := New(2, -1, 0*time.Second, f)
+	c.Set("key1", "1")
+	c.Flush()
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+	if v, ok := c.Peek("key1"); ok {
+		t.Fatalf("key1 should be evicted. Got %v", v)
+	}
+	c.Delete("key1")
+	c.Flush()
+	if v, ok := f.threadSafeGet("key1"); ok {
+		t.Errorf("the flusher should be told to remove key1. Got %v", v)
+	}
+}
+
+func TestExpiredEntryIsRemovedOnGet(t *testing.T) {
+	clk := newFakeClock()
+	c := NewSimple(5)
+	c.clock = clk
+	c.SetWithExpiry("key1", "1", time.Second)
+	c.SetWithExpiry("key2", "2", 0)
+	clk.Advance(time.Second)
+	if v, ok := c.GetOK("key1"); ok || v != nil {
+		t.Errorf("key1 should have expired. Got %v, %v", v, ok)
+	}
+	if len(c.data) != 1 || c.list.Len() != 1 {
+		t.Errorf("expired entry should leave both map and list. Got %v and %v entries", len(c.data), c.list.Len())
+	}
+	expectCachedValueEquals(t, c, "key2", "2")
+}
+
+func TestKeys(t *testing.T) {
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		var keys func() []string
+		switch c := c.(type) {
+		case *SimpleCache:
+			keys = c.Keys
+		case *Cache:
+			keys = c.Keys
+		}
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		c.Set("key3", "3")
+		c.Get("key2")
+		expected := []string{"key2", "key3", "key1"}
+		if got := keys(); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("keys should be %v. Got %v", expected, got)
+		}
+		// Keys does not promote.
+		if got := keys(); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("keys should still be %v. Got %v", expected, got)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		c.Get("key1")
+		s := fmt.Sprint(c)
+		if !strings.Contains(s, "nr elems 2 <= 5") {
+			t.Errorf("should describe the size of the cache. Got %q", s)
+		}
+		if i, j := strings.Index(s, "key1: 1"), strings.Index(s, "key2: 2"); i < 0 || j < 0 || i > j {
+			t.Errorf("should list key1 before key2. Got %q", s)
+		}
+	}
+	if s := caches[1].(*Cache).String(); !strings.Contains(s, "key2: 2; modified: true") {
+		t.Errorf("should list the dirty elements. Got %q", s)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	caches := []CacheInterface{NewSimple(2), New(2, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		var touch func(string) bool
+		switch c := c.(type) {
+		case *SimpleCache:
+			touch = c.Touch
+		case *Cache:
+			touch = c.Touch
+		}
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		if !touch("key1") {
+			t.Errorf("key1 should be touched")
+		}
+		if touch("notexist") {
+			t.Errorf("notexist should not be touched")
+		}
+		c.Set("key3", "3")
+		if v := c.Get("key2"); v != nil {
+			t.Errorf("key2 should be evicted. Got %v", v)
+		}
+		expectCachedValueEquals(t, c, "key1", "1")
+	}
+
+	c := NewSimple(2)
+	clk := newFakeClock()
+	c.clock = clk
+	c.SetWithExpiry("key1", "1", time.Minute)
+	clk.Advance(50 * time.Second)
+	c.Touch("key1")
+	clk.Advance(50 * time.Second)
+	expectCachedValueEquals(t, c, "key1", "1")
+	clk.Advance(time.Minute)
+	if c.Touch("key1") {
+		t.Errorf("expired key1 should not be touched")
+	}
+}
+
+func TestGetAndRefreshIfExpiring(t *testing.T) {
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		clk := newFakeClock()
+		var get func(key string, window, newTTL time.Duration) (interface{}, bool)
+		var setWithExpiry func(key string, value interface{}, ttl time.Duration)
+		var getItem func(key string) (Item, bool)
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.clock = clk
+			get, setWithExpiry, getItem = c.GetAndRefreshIfExpiring, c.SetWithExpiry, c.GetItem
+		case *Cache:
+			c.clock = clk
+			get, setWithExpiry, getItem = c.GetAndRefreshIfExpiring, c.SetWithExpiry, c.GetItem
+		}
+		setWithExpiry("key1", "1", time.Minute)
+		c.Set("key2", "2")
+		expires := clk.Now().Add(time.Minute)
+
+		// Far from expiring, the expiry is left alone.
+		clk.Advance(30 * time.Second)
+		if v, ok := get("key1", 10*time.Second, time.Hour); !ok || v != "1" {
+			t.Errorf("should be 1 on key1. Got %v", v)
+		}
+		if item, _ := getItem("key1"); !item.Expires.Equal(expires) {
+			t.Errorf("key1 should still expire at %v. Got %v", expires, item.Expires)
+		}
+		clk.Advance(25 * time.Second)
+		if v, ok := get("key1", 10*time.Second, time.Hour); !ok || v != "1" {
+			t.Errorf("should be 1 on key1. Got %v", v)
+		}
+		// Within the window, key1 got an hour more.
+		clk.Advance(59 * time.Minute)
+		expectCachedValueEquals(t, c, "key1", "1")
+		clk.Advance(2 * time.Minute)
+		if v := c.Get("key1"); v != nil {
+			t.Errorf("key1 should expire an hour after the refresh. Got %v", v)
+		}
+
+		if v, ok := get("key2", time.Minute, time.Hour); !ok || v != "2" {
+			t.Errorf("should be 2 on key2. Got %v", v)
+		}
+		clk.Advance(24 * time.Hour)
+		expectCachedValueEquals(t, c, "key2", "2")
+		if _, ok := get("notexist", time.Minute, time.Hour); ok {
+			t.Errorf("Got notexist")
+		}
+	}
+}
+
+func TestFlushLeavesStoreEqualToCache(t *testing.T) {
+	f := newMemFlusher()
+	c := New(-1, -1, 0*time.Second, f)
+	r := rand.New(rand.NewSource(1))
+	keys := []string{"key1", "key2", "key3", "key4"}
+	for i := 0; i < 1000; i++ {
+		key := keys[r.Intn(len(keys))]
+		switch r.Intn(10) {
+		case 0:
+			c.Flush()
+		case 1, 2, 3:
+			c.Delete(key)
+		default:
+			c.Set(key, i)
+		}
+	}
+	c.Flush()
+	for _, key := range keys {
+		stored, inStore := f.threadSafeGet(key)
+		cached, inCache := c.GetOK(key)
+		if inStore != inCache || stored != cached {
+			t.Errorf("store should hold %v on %v. Got %v", cached, key, stored)
+		}
+	}
+
+	// The last modification wins whatever came before it.
+	for _, ops := range [][]string{{"A", "B", ""}, {"A", "", "B"}, {"", "A", "B"}} {
+		for _, op := range ops {
+			if op == "" {
+				c.Delete("key1")
+			} else {
+				c.Set("key1", op)
+			}
+		}
+		c.Flush()
+		last := ops[len(ops)-1]
+		if v, ok := f.threadSafeGet("key1"); (last == "" && ok) || (last != "" && v != last) {
+			t.Errorf("store should follow %v. Got %v", ops, v)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	f := newCountingFlusher()
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, f)}
+	for _, c := range caches {
+		var remove func(string) (interface{}, bool)
+		switch c := c.(type) {
+		case *SimpleCache:
+			remove = c.Remove
+		case *Cache:
+			remove = c.Remove
+		}
+		c.Set("nil", nil)
+		c.Set("key1", "1")
+		if v, existed := remove("nil"); !existed || v != nil {
+			t.Errorf("stored nil should be removed. Got %v, %v", v, existed)
+		}
+		if v, existed := remove("nil"); existed || v != nil {
+			t.Errorf("nil should be gone. Got %v, %v", v, existed)
+		}
+		if v, existed := remove("key1"); !existed || v != "1" {
+			t.Errorf("key1 should be removed. Got %v, %v", v, existed)
+		}
+		if _, existed := remove("notexist"); existed {
+			t.Errorf("notexist should not exist")
+		}
+	}
+	caches[1].Flush()
+	if n := f.removes(); n != 2 {
+		t.Errorf("each removed key should reach the flusher once. Got %v removes", n)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	f := newMemFlusher()
+	c := New(5, 0, 0*time.Second, f)
+	for i := 0; i < 3; i++ {
+		key := strconv.Itoa(i)
+		c.Set(key, key)
+		if v, _ := f.threadSafeGet(key); v != key {
+			t.Errorf("Set should write %v through. Got %v", key, v)
+		}
+		expectCachedValueEquals(t, c, key, key)
+	}
+	c.Delete("1")
+	if _, ok := f.threadSafeGet("1"); ok {
+		t.Errorf("Delete should remove 1 through")
+	}
+	if n := c.dirtyList.Len(); n != 0 {
+		t.Errorf("nothing should stay dirty. Got %v", n)
+	}
+	if n := c.FlushCount(); n != 4 {
+		t.Errorf("each modification should be flushed once. Got %v flushes", n)
+	}
+}
+
+func TestWriteThroughDeletesEvictedKey(t *testing.T) {
+	f := newCountingFlusher()
+	c := New(1, 0, 0*time.Second, f)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	if c.Len() != 1 {
+		t.Errorf("key1 should be evicted. Got %v entries", c.Len())
+	}
+	c.Delete("key1")
+	if _, ok := f.threadSafeGet("key1"); ok {
+		t.Errorf("Delete of an evicted key should be written through")
+	}
+	if n := f.removes(); n != 1 {
+		t.Errorf("flusher should remove key1 once. Got %v removes", n)
+	}
+}
+
+func TestNoCacheDeletesFlushedKey(t *testing.T) {
+	f := newCountingFlusher()
+	c := New(0, -1, 0*time.Second, f)
+	c.Set("key1", "1")
+	c.Flush()
+	if v, _ := f.threadSafeGet("key1"); v != "1" {
+		t.Errorf("Set should reach the flusher. Got %v", v)
+	}
+	c.Delete("key1")
+	c.Flush()
+	if _, ok := f.threadSafeGet("key1"); ok {
+		t.Errorf("Delete should reach the flusher")
+	}
+}
+
+func TestSnapshotIsACopy(t *testing.T) {
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		var snapshot func() []Entry
+		switch c := c.(type) {
+		case *SimpleCache:
+			snapshot = c.Snapshot
+		case *Cache:
+			snapshot = c.Snapshot
+		}
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		entries := snapshot()
+		entries[0].Value = "changed"
+		c.Set("key3", "3")
+		c.Delete("key1")
+		expectCachedValueEquals(t, c, "key2", "2")
+		if len(entries) != 2 || entries[1] != (Entry{"key1", "1"}) {
+			t.Errorf("snapshot should not follow the cache. Got %v", entries)
+		}
+	}
+}
+
+func TestSetIfAbsent(t *testing.T) {
+	f := newCountingFlusher()
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, f)}
+	for _, c := range caches {
+		var setIfAbsent, setIfPresent func(string, interface{}) bool
+		switch c := c.(type) {
+		case *SimpleCache:
+			setIfAbsent, setIfPresent = c.SetIfAbsent, c.SetIfPresent
+		case *Cache:
+			setIfAbsent, setIfPresent = c.SetIfAbsent, c.SetIfPresent
+		}
+		var wg sync.WaitGroup
+		var winners int32
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if setIfAbsent("key1", i) {
+					atomic.AddInt32(&winners, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if winners != 1 {
+			t.Errorf("exactly one SetIfAbsent should insert. Got %v", winners)
+		}
+
+		var updates, inserts int32
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if setIfPresent("key1", i) {
+					atomic.AddInt32(&updates, 1)
+				}
+				if setIfPresent("key2", i) {
+					atomic.AddInt32(&inserts, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if updates != 50 || inserts != 0 {
+			t.Errorf("SetIfPresent should update key1 only. Got %v updates, %v inserts", updates, inserts)
+		}
+		if v := c.Get("key2"); v != nil {
+			t.Errorf("key2 should not be set. Got %v", v)
+		}
+	}
+	caches[1].Flush()
+	if n := f.adds(); n != 1 {
+		t.Errorf("only key1 should reach the flusher. Got %v adds", n)
+	}
+}
+
+func TestDeleteTriggersFlush(t *testing.T) {
+	f := newCountingFlusher()
+	c := New(10, 2, 0*time.Second, f)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Delete("key1")
+	c.Delete("key2")
+	if n := f.removes(); n != 2 {
+		t.Errorf("reaching maxNrDirty by Delete should flush. Got %v removes", n)
+	}
+}
+
+func TestMaxDirtyAge(t *testing.T) {
+	f := &failingFlusher{memFlusher: newMemFlusher(), fail: map[string]bool{"key2": true}}
+	clk := newFakeClock()
+	c := NewWithErrorFlusher(10, 100, 0*time.Second, f)
+	c.clock = clk
+	c.SetMaxDirtyAge(time.Minute)
+
+	c.Set("key1", "1")
+	clk.Advance(30 * time.Second)
+	c.Set("key2", "2")
+	if _, ok := f.threadSafeGet("key1"); ok {
+		t.Errorf("key1 should not be flushed yet")
+	}
+	clk.Advance(30 * time.Second)
+	if v, _ := f.threadSafeGet("key1"); v != "1" {
+		t.Errorf("aged key1 should be flushed. Got %v", v)
+	}
+
+	// A failed write is retried once it is maxAge old again.
+	delete(f.fail, "key2")
+	clk.Advance(time.Minute)
+	if v, _ := f.threadSafeGet("key2"); v != "2" {
+		t.Errorf("key2 should be flushed on retry. Got %v", v)
+	}
+	if n := c.dirtyList.Len(); n != 0 {
+		t.Errorf("nothing should stay dirty. Got %v", n)
+	}
+
+	c.Close()
+	c.Set("key3", "3")
+	clk.Advance(time.Hour)
+	if _, ok := f.threadSafeGet("key3"); ok {
+		t.Errorf("no flush should run in the background after Close")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	f := &failingFlusher{memFlusher: newMemFlusher(), fail: map[string]bool{}}
+	c := NewWithErrorFlusher(10, -1, 0*time.Second, f)
+	for i := 0; i < 5; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	c.Delete("4")
+	if n, err := c.Drain(); n != 5 || err != nil {
+		t.Errorf("Drain should write 5 modifications. Got %v, %v", n, err)
+	}
+	c.Close()
+	c.Set("5", 5)
+	if n, err := c.Drain(); n != 1 || err != nil {
+		t.Errorf("Drain should still work after Close. Got %v, %v", n, err)
+	}
+	for i := 0; i < 6; i++ {
+		v, _ := f.threadSafeGet(strconv.Itoa(i))
+		if i == 4 && v != nil || i != 4 && v != i {
+			t.Errorf("flusher should be up to date on key %v. Got %v", i, v)
+		}
+	}
+
+	f.fail["6"] = true
+	c.Set("6", 6)
+	if n, err := c.Drain(); n != 0 || err == nil {
+		t.Errorf("Drain should report the failed write. Got %v, %v", n, err)
+	}
+}
+
+func TestSetIfAbsentSeesOverflowedKey(t *testing.T) {
+	store := &memOverflowStore{data: make(map[string]interface{})}
+	c := New(1, -1, 0*time.Second, newMemFlusher())
+	c.SetOverflowStore(store)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	if c.SetIfAbsent("key1", "other") {
+		t.Errorf("key1 in the overflow store should not be overwritten")
+	}
+	if v := c.Get("key1"); v != "1" {
+		t.Errorf("should be 1 on key1. Got %v", v)
+	}
+	// Reading key1 back evicted key2 to the overflow store.
+	if _, ok := store.data["key2"]; !ok {
+		t.Fatalf("key2 should be in the overflow store")
+	}
+	if !c.SetIfPresent("key2", "other") {
+		t.Errorf("key2 in the overflow store should be updated")
+	}
+	if v := c.Get("key2"); v != "other" {
+		t.Errorf("should be other on key2. Got %v", v)
+	}
+}
+
+func TestTrySet(t *testing.T) {
+	f := newCountingFlusher()
+	caches := []CacheInterface{NewSimple(2), New(2, -1, 0*time.Second, f)}
+	for _, c := range caches {
+		var trySet func(string, interface{}) bool
+		switch c := c.(type) {
+		case *SimpleCache:
+			trySet = c.TrySet
+		case *Cache:
+			trySet = c.TrySet
+		}
+		if !trySet("key1", "1") || !trySet("key2", "2") {
+			t.Errorf("TrySet should store while there is room")
+		}
+		if trySet("key3", "3") {
+			t.Errorf("TrySet should not store a new key in a full cache")
+		}
+		if !trySet("key1", "11") {
+			t.Errorf("TrySet should update a cached key")
+		}
+		expectCachedValueEquals(t, c, "key1", "11")
+		expectCachedValueEquals(t, c, "key2", "2")
+		if v := c.Get("key3"); v != nil {
+			t.Errorf("key3 should not be stored. Got %v", v)
+		}
+	}
+	caches[1].Flush()
+	if n := f.adds(); n != 2 {
+		t.Errorf("only stored keys should reach the flusher. Got %v adds", n)
+	}
+}
+
+func TestDirtyLenAndCap(t *testing.T) {
+	c := New(5, -1, 0*time.Second, newMemFlusher())
+	for i := 1; i <= 3; i++ {
+		c.Set(strconv.Itoa(i), i)
+		if n := c.DirtyLen(); n != i {
+			t.Errorf("should have %v dirty. Got %v", i, n)
+		}
+	}
+	c.Delete("1")
+	if n := c.DirtyLen(); n != 3 {
+		t.Errorf("the removal should replace the pending Set. Got %v dirty", n)
+	}
+	c.Flush()
+	if n := c.DirtyLen(); n != 0 {
+		t.Errorf("nothing should be dirty after Flush. Got %v", n)
+	}
+
+	for _, capacity := range []int{5, 0, -1} {
+		if n := NewSimple(capacity).Cap(); n != capacity {
+			t.Errorf("SimpleCache capacity should be %v. Got %v", capacity, n)
+		}
+		if n := New(capacity, -1, 0*time.Second, newMemFlusher()).Cap(); n != capacity {
+			t.Errorf("Cache capacity should be %v. Got %v", capacity, n)
+		}
+	}
+	s := NewSimple(5)
+	s.Resize(3)
+	if n := s.Cap(); n != 3 {
+		t.Errorf("capacity should follow Resize. Got %v", n)
+	}
+}
+
+func TestRemoveFunc(t *testing.T) {
+	f := newCountingFlusher()
+	caches := []CacheInterface{NewSimple(10), New(10, -1, 0*time.Second, f)}
+	for _, c := range caches {
+		var removeFunc func(func(string, interface{}) bool) int
+		switch c := c.(type) {
+		case *SimpleCache:
+			removeFunc = c.RemoveFunc
+		case *Cache:
+			removeFunc = c.RemoveFunc
+		}
+		for _, k := range []string{"user:1", "user:2", "group:1", "user:3", "key1"} {
+			c.Set(k, k)
+		}
+		n := removeFunc(func(key string, value interface{}) bool {
+			return strings.HasPrefix(key, "user:")
+		})
+		if n != 3 {
+			t.Errorf("should remove 3 entries. Got %v", n)
+		}
+		if c.Len() != 2 {
+			t.Errorf("cache should hold 2 entries. Got %v", c.Len())
+		}
+		for _, k := range []string{"user:1", "user:2", "user:3"} {
+			if v := c.Get(k); v != nil {
+				t.Errorf("%v should be removed. Got %v", k, v)
+			}
+		}
+		expectCachedValueEquals(t, c, "group:1", "group:1")
+		expectCachedValueEquals(t, c, "key1", "key1")
+	}
+	caches[1].Flush()
+	if n := f.removes(); n != 3 {
+		t.Errorf("each removal should reach the flusher. Got %v removes", n)
+	}
+}
+
+func TestConcurrentSetsFlushEachModificationOnce(t *testing.T) {
+	f := newCountingFlusher()
+	c := New(-1, 3, 0*time.Second, f)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				c.Set(strconv.Itoa(g)+":"+strconv.Itoa(i), i)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := c.DirtyLen(); n >= 3 {
+		t.Errorf("fewer than maxNrDirty should be left dirty. Got %v", n)
+	}
+	c.Flush()
+	if n := f.adds(); n != 8*200 {
+		t.Errorf("every Set should be written exactly once. Got %v writes", n)
+	}
+	for g := 0; g < 8; g++ {
+		key := strconv.Itoa(g) + ":199"
+		if v, _ := f.threadSafeGet(key); v != 199 {
+			t.Errorf("flusher should have 199 on %v. Got %v", key, v)
+		}
+	}
+}
+
+func TestConcurrentFlushesWriteEachKeyOnce(t *testing.T) {
+	f := newCountingFlusher()
+	c := New(-1, -1, 0*time.Second, f)
+	var wg sync.WaitGroup
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			key := strconv.Itoa(g)
+			c.Set(key, g)
+			c.Flush()
+			// Even when coalesced into another flush, Flush returns only
+			// once what was set before it is written.
+			if v, ok := f.threadSafeGet(key); !ok || v != g {
+				t.Errorf("flusher should have %v on %v after Flush. Got %v", g, key, v)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := f.adds(); n != 50 {
+		t.Errorf("every key should be written exactly once. Got %v writes", n)
+	}
+}
+
+func TestGetItem(t *testing.T) {
+	caches := []CacheInterface{NewSimple(5), New(5, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		clk := newFakeClock()
+		var getItem func(string) (Item, bool)
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.clock = clk
+			getItem = c.GetItem
+		case *Cache:
+			c.clock = clk
+			getItem = c.GetItem
+		}
+		created := clk.Now()
+		c.Set("key1", "1")
+		item, ok := getItem("key1")
+		if !ok || item.Entry != (Entry{"key1", "1"}) || item.Hits != 0 {
+			t.Errorf("should get key1 unread. Got %+v", item)
+		}
+		if !item.Created.Equal(created) || !item.LastAccess.Equal(created) || !item.Expires.IsZero() {
+			t.Errorf("key1 should be created and last accessed at %v. Got %+v", created, item)
+		}
+
+		for i := 0; i < 3; i++ {
+			clk.Advance(time.Second)
+			c.Get("key1")
+		}
+		item, _ = getItem("key1")
+		if item.Hits != 3 {
+			t.Errorf("should count 3 hits. Got %v", item.Hits)
+		}
+		if accessed := created.Add(3 * time.Second); !item.LastAccess.Equal(accessed) {
+			t.Errorf("last access should be %v. Got %v", accessed, item.LastAccess)
+		}
+		if again, _ := getItem("key1"); again.Hits != 3 {
+			t.Errorf("GetItem should not count as a hit. Got %v", again.Hits)
+		}
+		if _, ok := getItem("notexist"); ok {
+			t.Errorf("notexist should not be found")
+		}
+	}
+}
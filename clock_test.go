@@ -0,0 +1,122 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when Advance is called. Timers
+// fire synchronously from Advance.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c       *fakeClock
+	when    time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+// Advance moves the clock forward by d, firing every timer that becomes
+// due in the order they are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].when.Before(c.timers[j].when)
+		})
+		var due *fakeTimer
+		for len(c.timers) > 0 && due == nil {
+			t := c.timers[0]
+			if t.when.After(end) {
+				break
+			}
+			c.timers = c.timers[1:]
+			if !t.stopped {
+				due = t
+			}
+		}
+		if due == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		due.stopped = true
+		c.now = due.when
+		c.mu.Unlock()
+		due.f()
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	c := newFakeClock()
+	start := c.Now()
+	var fired []int
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	c.AfterFunc(1*time.Second, func() { fired = append(fired, 1) })
+	stopped := c.AfterFunc(1*time.Second, func() { fired = append(fired, 0) })
+	stopped.Stop()
+
+	c.Advance(1500 * time.Millisecond)
+	if len(fired) != 1 || fired[0] != 1 {
+		t.Errorf("only the 1s timer should have fired. Got %v", fired)
+	}
+	c.Advance(1 * time.Second)
+	if len(fired) != 2 || fired[1] != 2 {
+		t.Errorf("the 2s timer should have fired. Got %v", fired)
+	}
+	if elapsed := c.Now().Sub(start); elapsed != 2500*time.Millisecond {
+		t.Errorf("clock should have advanced 2.5s. Got %v", elapsed)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"container/heap"
+	"context"
+	"time"
+)
+
+// expiryHeap orders the items set with an expiry soonest first, so that a
+// sweep only looks at the entries that are due. Each item knows its place
+// in the heap, so that a new expiry moves it rather than adding it again.
+type expiryHeap []*cacheItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expiryIndex = i + 1
+	h[j].expiryIndex = j + 1
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*cacheItem)
+	*h = append(*h, item)
+	item.expiryIndex = len(*h)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	item.expiryIndex = 0
+	return item
+}
+
+// NewExpiring creates a SimpleCache like NewSimple that also removes
+// entries set with SetWithExpiry once they expire, checking every
+// sweepInterval, instead of only when they are next read. The sweeper
+// runs in the background until Close. A non-positive sweepInterval means
+// no sweeper, like a zero flush period for New: the cache is then just
+// NewSimple, whose entries expire only when read.
+func NewExpiring(capacity int, sweepInterval time.Duration) *SimpleCache {
+	c := NewSimple(capacity)
+	if sweepInterval <= 0 {
+		return c
+	}
+	c.expiries = new(expiryHeap)
+	c.background.spawn(func(ctx context.Context) {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.sweep()
+			}
+		}
+	})
+	return c
+}
+
+// sweep removes every entry that has expired.
+func (c *lru) sweep() {
+	c.mu.Lock()
+	defer c.unlock()
+	now := c.time().Now()
+	for h := c.expiries; h.Len() > 0 && !now.Before((*h)[0].expires); {
+		c.expire((*h)[0])
+	}
+}
+
+// scheduleExpiry puts item in its place in the expiry heap, if the cache
+// has one. The caller must hold c.mu.
+func (c *lru) scheduleExpiry(item *cacheItem) {
+	if c.expiries == nil {
+		return
+	}
+	if item.expiryIndex > 0 {
+		heap.Fix(c.expiries, item.expiryIndex-1)
+	} else {
+		heap.Push(c.expiries, item)
+	}
+}
+
+// unscheduleExpiry takes item out of the expiry heap, if it is in it,
+// once item leaves the cache or stops expiring. The caller must hold c.mu.
+func (c *lru) unscheduleExpiry(item *cacheItem) {
+	if item.expiryIndex > 0 {
+		heap.Remove(c.expiries, item.expiryIndex-1)
+	}
+}
+
+// resetExpiries forgets every expiry once the cache is emptied. The caller
+// must hold c.mu.
+func (c *lru) resetExpiries() {
+	if c.expiries != nil {
+		for _, item := range *c.expiries {
+			item.expiryIndex = 0
+		}
+		*c.expiries = nil
+	}
+}
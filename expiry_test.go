@@ -0,0 +1,96 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpiringCacheSweepsUntouchedEntries(t *testing.T) {
+	c := NewExpiring(5, 10*time.Millisecond)
+	defer c.Close()
+	c.SetWithExpiry("key1", "1", 20*time.Millisecond)
+	c.SetWithExpiry("key2", "2", time.Hour)
+	c.Set("key3", "3")
+	// Replacing a value drops its expiry.
+	c.SetWithExpiry("key4", "4", 20*time.Millisecond)
+	c.Set("key4", "44")
+
+	deadline := time.Now().Add(time.Second)
+	for c.Stats().Len != 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := c.Stats().Len; n != 3 {
+		t.Errorf("key1 should be swept without being read. Got %v entries", n)
+	}
+	for _, key := range []string{"key2", "key3", "key4"} {
+		if !c.Contains(key) {
+			t.Errorf("%v should stay", key)
+		}
+	}
+
+	c.Close()
+	if n := c.NumBackgroundGoroutines(); n != 0 {
+		t.Errorf("sweeper should exit on Close. Got %v goroutines", n)
+	}
+}
+
+func TestNewExpiringWithoutSweeper(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		clk := newFakeClock()
+		c := NewExpiring(5, interval)
+		c.clock = clk
+		if n := c.NumBackgroundGoroutines(); n != 0 {
+			t.Errorf("sweepInterval %v should not start a sweeper. Got %v goroutines", interval, n)
+		}
+		c.SetWithExpiry("key1", "1", time.Second)
+		clk.Advance(time.Second)
+		if v := c.Get("key1"); v != nil {
+			t.Errorf("key1 should still expire when read. Got %v", v)
+		}
+		c.Close()
+	}
+}
+
+func TestExpiryHeapHoldsEachEntryOnce(t *testing.T) {
+	c := NewExpiring(5, time.Hour)
+	defer c.Close()
+	c.SetWithExpiry("key1", "1", time.Minute)
+	for i := 0; i < 10000; i++ {
+		c.Touch("key1")
+	}
+	if n := c.expiries.Len(); n != 1 {
+		t.Errorf("Touch should move key1 in the heap, not add it again. Got %v entries", n)
+	}
+
+	c.SetWithExpiry("key2", "2", time.Minute)
+	c.Set("key2", "22")
+	c.Delete("key1")
+	if n := c.expiries.Len(); n != 0 {
+		t.Errorf("deleted and overwritten entries should leave the heap. Got %v entries", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		c.SetWithExpiry(strconv.Itoa(i), i, time.Minute)
+	}
+	if n := c.expiries.Len(); n != c.Len() {
+		t.Errorf("evicted entries should leave the heap. Got %v entries for %v cached", n, c.Len())
+	}
+}
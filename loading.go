@@ -0,0 +1,221 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by a loader for keys that do not exist. With
+// SetNegativeTTL, a LoadingCache remembers such keys for a while instead
+// of asking the loader again.
+var ErrNotFound = errors.New("cache2: not found")
+
+// LoadingCache is a SimpleCache that loads missing values itself. Each
+// miss calls the loader once, however many goroutines are waiting for the
+// same key.
+type LoadingCache struct {
+	*SimpleCache
+	loader      func(key string) (interface{}, error)
+	negativeTTL time.Duration
+
+	// Loaded values expire after ttl, and are reloaded by a Get once they
+	// are refreshAfter old.
+	ttl, refreshAfter time.Duration
+}
+
+// notFound is cached under keys the loader did not find.
+type notFound struct{}
+
+// NewLoading creates a LoadingCache holding at most capacity entries and
+// loading them with loader. capacity means as for NewSimple.
+func NewLoading(capacity int, loader func(key string) (interface{}, error)) *LoadingCache {
+	return &LoadingCache{SimpleCache: NewSimple(capacity), loader: loader}
+}
+
+// SetNegativeTTL makes the cache remember for ttl that the loader returned
+// ErrNotFound for a key, so that Get returns ErrNotFound again without
+// calling it. These entries count towards the capacity and are evicted
+// like any other. ttl <= 0, the default, turns this off.
+func (c *LoadingCache) SetNegativeTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.negativeTTL = ttl
+}
+
+// SetRefreshAhead makes loaded values expire after ttl, and makes a Get
+// that finds a value older than fraction of ttl reload it in the
+// background. The Get returns the current value without waiting, and the
+// reloaded value replaces it without counting as an access. Only one
+// reload of a key runs at a time, and one that fails leaves the current
+// value to expire. ttl <= 0, the default, keeps loaded values until they
+// are evicted.
+func (c *LoadingCache) SetRefreshAhead(ttl time.Duration, fraction float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+	c.refreshAfter = time.Duration(float64(ttl) * fraction)
+}
+
+// Get returns the value stored under key, loading and storing it on a
+// miss. Concurrent Gets of the same missing key share a single call to
+// the loader. If the loader fails, its error is returned to all of them
+// and nothing is stored, so the next Get tries again.
+func (c *LoadingCache) Get(key string) (interface{}, error) {
+	value, err := c.getOrCompute(key, c.loadFunc(key), c.GetOK, c.store)
+	c.refreshIfDue(key)
+	if value == (notFound{}) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+// prewarmWorkers bounds the number of loads Prewarm runs at once.
+const prewarmWorkers = 8
+
+// Prewarm loads and stores the values of keys that are not cached yet, a
+// few at a time, so that the first Gets of keys known to be hot do not
+// wait for the loader. It neither promotes the keys that are cached nor
+// counts hits, and stores within the capacity like Get. Keys the loader
+// does not find are skipped; Prewarm returns the other load errors,
+// joined with errors.Join.
+func (c *LoadingCache) Prewarm(keys []string) error {
+	todo := make(chan string)
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for i := 0; i < prewarmWorkers && i < len(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range todo {
+				_, err := c.getOrCompute(key, c.loadFunc(key), c.Peek, c.store)
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, key := range keys {
+		todo <- key
+	}
+	close(todo)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// loadFunc returns the call to the loader that loads key.
+func (c *LoadingCache) loadFunc(key string) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		value, err := c.loader(key)
+		if errors.Is(err, ErrNotFound) && c.rememberMisses() {
+			return notFound{}, nil
+		}
+		return value, err
+	}
+}
+
+func (c *LoadingCache) rememberMisses() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.negativeTTL > 0
+}
+
+func (c *LoadingCache) store(key string, value interface{}) {
+	c.mu.RLock()
+	ttl := c.ttl
+	if value == (notFound{}) {
+		ttl = c.negativeTTL
+	}
+	c.mu.RUnlock()
+	c.SetWithExpiry(key, value, ttl)
+}
+
+// refreshIfDue starts reloading key in the background if its value is
+// due for it and no load of key is running.
+func (c *LoadingCache) refreshIfDue(key string) {
+	c.mu.RLock()
+	enabled := c.refreshAfter > 0
+	c.mu.RUnlock()
+	if !enabled {
+		return
+	}
+
+	c.mu.Lock()
+	elem, ok := c.data[key]
+	if !ok || c.computing[key] != nil {
+		c.mu.Unlock()
+		return
+	}
+	item := elem.Value.(*cacheItem)
+	if item.ttl <= 0 || item.value == (notFound{}) ||
+		c.time().Now().Before(item.expires.Add(c.refreshAfter-item.ttl)) {
+		c.mu.Unlock()
+		return
+	}
+	if c.computing == nil {
+		c.computing = make(map[string]*computation)
+	}
+	running := &computation{done: make(chan struct{})}
+	c.computing[key] = running
+	c.mu.Unlock()
+
+	started := c.background.spawn(func(ctx context.Context) {
+		defer c.refreshed(key, running)
+		c.refresh(key, running)
+	})
+	if !started {
+		// The cache is closed, so the current value is left to expire.
+		c.refreshed(key, running)
+	}
+}
+
+// refreshed ends the reload of key started by refreshIfDue.
+func (c *LoadingCache) refreshed(key string, running *computation) {
+	c.mu.Lock()
+	delete(c.computing, key)
+	c.mu.Unlock()
+	close(running.done)
+}
+
+// refresh reloads key for refreshIfDue. It runs in the background until
+// Close, which waits for the loader to return. Gets that miss key
+// meanwhile wait for it like for any other load.
+func (c *LoadingCache) refresh(key string, running *computation) {
+	running.value, running.err = c.loader(key)
+	if running.err != nil {
+		running.value = nil
+		return
+	}
+
+	c.mu.Lock()
+	defer c.unlock()
+	if elem, ok := c.data[key]; ok {
+		item := elem.Value.(*cacheItem)
+		c.update(item, running.value)
+		c.expireAfter(item, c.ttl)
+		return
+	}
+	c.expireAfter(c.set(key, running.value, c.now()), c.ttl)
+	c.shrink()
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadingCacheLoadsOnceUnderStampede(t *testing.T) {
+	var nrLoads int32
+	release := make(chan struct{})
+	c := NewLoading(5, func(key string) (interface{}, error) {
+		atomic.AddInt32(&nrLoads, 1)
+		<-release
+		return "value of " + key, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.Get("key1"); err != nil || v != "value of key1" {
+				t.Errorf("should load key1. Got %v, %v", v, err)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&nrLoads); n != 1 {
+		t.Errorf("loader should be called once. Got %v calls", n)
+	}
+	if v, ok := c.GetOK("key1"); !ok || v != "value of key1" {
+		t.Errorf("loaded value should be cached. Got %v", v)
+	}
+}
+
+func TestLoadingCacheDoesNotCacheErrors(t *testing.T) {
+	fail := true
+	c := NewLoading(5, func(key string) (interface{}, error) {
+		if fail {
+			return nil, errors.New("backend unavailable")
+		}
+		return "1", nil
+	})
+	if v, err := c.Get("key1"); err == nil || v != nil {
+		t.Errorf("should report the load failure. Got %v, %v", v, err)
+	}
+	if c.Len() != 0 {
+		t.Errorf("failed load should not be cached")
+	}
+	fail = false
+	if v, err := c.Get("key1"); err != nil || v != "1" {
+		t.Errorf("should load key1 again. Got %v, %v", v, err)
+	}
+}
+
+func TestLoadingCacheRemembersMissingKeys(t *testing.T) {
+	nrLoads := 0
+	c := NewLoading(2, func(key string) (interface{}, error) {
+		nrLoads++
+		if key == "notexist" {
+			return nil, ErrNotFound
+		}
+		return key, nil
+	})
+	clk := newFakeClock()
+	c.clock = clk
+	c.SetNegativeTTL(time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if v, err := c.Get("notexist"); err != ErrNotFound || v != nil {
+			t.Errorf("should not find notexist. Got %v, %v", v, err)
+		}
+	}
+	if nrLoads != 1 {
+		t.Errorf("the miss should be remembered. Got %v loads", nrLoads)
+	}
+	clk.Advance(time.Minute)
+	c.Get("notexist")
+	if nrLoads != 2 {
+		t.Errorf("the miss should be forgotten after the ttl. Got %v loads", nrLoads)
+	}
+
+	// Remembered misses are evicted like other entries.
+	c.Get("key1")
+	c.Get("key2")
+	c.Get("notexist")
+	if nrLoads != 5 {
+		t.Errorf("the miss should have been evicted. Got %v loads", nrLoads)
+	}
+}
+
+func TestLoadingCacheRefreshesAhead(t *testing.T) {
+	var nrLoads int32
+	release := make(chan struct{})
+	c := NewLoading(5, func(key string) (interface{}, error) {
+		if n := atomic.AddInt32(&nrLoads, 1); n > 1 {
+			<-release
+			return "new", nil
+		}
+		return "old", nil
+	})
+	clk := newFakeClock()
+	c.clock = clk
+	c.SetRefreshAhead(time.Minute, 0.5)
+
+	if v, _ := c.Get("key1"); v != "old" {
+		t.Errorf("should load old on key1. Got %v", v)
+	}
+	clk.Advance(20 * time.Second)
+	c.Get("key1")
+	if n := atomic.LoadInt32(&nrLoads); n != 1 {
+		t.Errorf("a fresh value should not be reloaded. Got %v loads", n)
+	}
+
+	// The reload is blocked, so these Gets must not wait for it.
+	clk.Advance(20 * time.Second)
+	for i := 0; i < 3; i++ {
+		if v, _ := c.Get("key1"); v != "old" {
+			t.Errorf("should serve old while reloading. Got %v", v)
+		}
+	}
+	if n := c.NumBackgroundGoroutines(); n != 1 {
+		t.Errorf("the reload should run in the background. Got %v goroutines", n)
+	}
+
+	// Close waits for the reload.
+	close(release)
+	c.Close()
+	if n := c.NumBackgroundGoroutines(); n != 0 {
+		t.Errorf("the reload should be done after Close. Got %v goroutines", n)
+	}
+	if v, _ := c.Peek("key1"); v != "new" {
+		t.Errorf("reloaded value should be stored. Got %v", v)
+	}
+	if n := atomic.LoadInt32(&nrLoads); n != 2 {
+		t.Errorf("key1 should be reloaded once. Got %v loads", n)
+	}
+
+	// The reloaded value gets a whole ttl.
+	clk.Advance(50 * time.Second)
+	if v, ok := c.Peek("key1"); !ok || v != "new" {
+		t.Errorf("reloaded value should not expire yet. Got %v", v)
+	}
+
+	// A closed cache no longer reloads in the background.
+	for i := 0; i < 2; i++ {
+		if v, _ := c.Get("key1"); v != "new" {
+			t.Errorf("should serve new after Close. Got %v", v)
+		}
+	}
+	if n := atomic.LoadInt32(&nrLoads); n != 2 {
+		t.Errorf("a closed cache should not reload. Got %v loads", n)
+	}
+}
+
+func TestLoadingCachePrewarm(t *testing.T) {
+	var mu sync.Mutex
+	loaded := make(map[string]int)
+	c := NewLoading(10, func(key string) (interface{}, error) {
+		mu.Lock()
+		loaded[key]++
+		mu.Unlock()
+		switch key {
+		case "notexist":
+			return nil, ErrNotFound
+		case "broken":
+			return nil, errors.New("backend unavailable")
+		}
+		return "value of " + key, nil
+	})
+	c.Set("cached", "old")
+	keys := []string{"cached", "notexist", "broken"}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, "key"+strconv.Itoa(i))
+	}
+	if err := c.Prewarm(keys); err == nil || !strings.Contains(err.Error(), "backend unavailable") {
+		t.Errorf("Prewarm should report the failed load. Got %v", err)
+	}
+
+	if loaded["cached"] != 0 {
+		t.Errorf("cached keys should not be loaded again")
+	}
+	for _, key := range keys[1:] {
+		if loaded[key] != 1 {
+			t.Errorf("%v should be loaded once. Got %v loads", key, loaded[key])
+		}
+	}
+	if len(loaded) != len(keys)-1 {
+		t.Errorf("only the requested keys should be loaded. Got %v", loaded)
+	}
+	if c.Len() != 10 {
+		t.Errorf("Prewarm should respect the capacity. Got %v entries", c.Len())
+	}
+	for _, key := range []string{"notexist", "broken"} {
+		if c.Contains(key) {
+			t.Errorf("%v should not be stored", key)
+		}
+	}
+	if n := c.HitCount(); n != 0 {
+		t.Errorf("Prewarm should not count hits. Got %v", n)
+	}
+}
@@ -0,0 +1,993 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxPreallocation bounds the number of entries the map is sized for up
+// front, so that a huge capacity does not turn into a huge allocation.
+// The map grows past it as entries are added.
+const maxPreallocation = 1 << 12
+
+// lru is the storage shared by SimpleCache and Cache: a map for lookups
+// and a list ordered from most to least recently used. The map is
+// allocated on the first insert, so a cache that is never written to
+// costs nothing beyond the struct itself.
+//
+// Recency is a logical clock: every item carries the sequence number of
+// its last access and the list is kept in descending sequence order.
+// Plain accesses take the next tick of the clock and so always move to
+// the front; SetAt and GetAt let callers supply the sequence themselves.
+//
+// Get only read-locks mu when it can. Such a Get cannot move the item, so
+// it stamps the item's accessed field with the next tick instead, and the
+// item is moved to its place by settle before the order is next needed.
+type lru struct {
+	// lastSeq, hits and misses are updated atomically by read-locked Gets,
+	// and the counters are read atomically by HitCount and the like. They
+	// come first so that they are 64-bit aligned on 32-bit platforms.
+	lastSeq   uint64
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	mu       sync.RWMutex
+	data     map[string]*list.Element
+	list     list.List
+	capacity int
+	clock    clock
+	merge    func(old, new interface{}) interface{}
+	onEvict  func(key string, value interface{})
+	policy   EvictionPolicy
+	observer Observer
+
+	// size is the total of sizer over all entries. It is only kept while
+	// a sizer is set, and then bounded by maxSize.
+	sizer   func(value interface{}) int
+	maxSize int
+	size    int
+
+	// Access counts are halved once per agingInterval since agingStart.
+	// policyEpoch is the interval the policy's counts were last aged in.
+	agingInterval time.Duration
+	agingStart    time.Time
+	policyEpoch   uint64
+
+	// closed is set by Close, after which no timer is armed again.
+	closed     bool
+	background supervisor
+	sampler    *utilizationSampler
+
+	// released holds the cleanups and notifications of what happened
+	// while the cache was locked. They run in unlock.
+	released []func()
+
+	nrMutations uint64
+	reportEvery uint64
+	reportSize  func(size int)
+	reportDue   bool
+
+	// computing holds the GetOrCompute calls in progress, by key.
+	computing map[string]*computation
+
+	// departures records why recently removed keys left the cache. It is
+	// nil unless TrackMissReasons was called.
+	departures *departureLog
+
+	// expiries holds the entries set with an expiry, soonest first, while
+	// a sweeper started by NewExpiring runs. It is nil otherwise.
+	expiries *expiryHeap
+}
+
+func (c *lru) Len() int {
+	return len(c.data)
+}
+
+// Cap returns the capacity the cache was created with or last resized to.
+// It is negative for a cache that is always in memory.
+func (c *lru) Cap() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capacity
+}
+
+// Peek returns the value stored under key like GetOK, but leaves the
+// entry's recency, its access count and the hit and miss counters alone.
+// An entry evicted from a Cache into its overflow store is not found.
+func (c *lru) Peek(key string) (interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.peek(key)
+}
+
+// GetItem returns the entry cached under key along with its metadata,
+// like Peek without promoting it or counting as a hit.
+func (c *lru) GetItem(key string) (Item, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.peek(key)
+	if !ok {
+		return Item{}, false
+	}
+	item := c.data[key].Value.(*cacheItem)
+	c.age(item)
+	return Item{
+		Entry:      Entry{Key: key, Value: value},
+		Created:    item.created,
+		LastAccess: time.Unix(0, item.lastAccess),
+		Expires:    item.expires,
+		Hits:       item.hits,
+	}, true
+}
+
+// Contains reports whether key is cached, like Peek but without returning
+// the value.
+func (c *lru) Contains(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.peek(key)
+	return ok
+}
+
+// writeElements lists the entries from the most to the least recently
+// used for String. The caller must hold c.mu.
+func (c *lru) writeElements(b *strings.Builder) {
+	c.settleAll()
+	b.WriteString("-----------------elements------------\n")
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*cacheItem)
+		fmt.Fprintf(b, "%v: %v\n", item.key, item.value)
+	}
+}
+
+// Keys returns the keys of the entries from the most to the least
+// recently used, without promoting them.
+func (c *lru) Keys() []string {
+	var keys []string
+	c.Range(func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Range calls f for every entry, from the most to the least recently
+// used, until f returns false. It neither promotes the entries nor counts
+// hits. The cache stays locked throughout, so f must not call back into
+// it; use Snapshot to work on the entries without the lock.
+func (c *lru) Range(f func(key string, value interface{}) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.settleAll()
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*cacheItem)
+		if c.expired(item) {
+			continue
+		}
+		if value, ok := resolve(item.value); ok && !f(item.key, value) {
+			return
+		}
+	}
+}
+
+// peek is Peek without the locking. The caller must hold c.mu, at least
+// for reading.
+func (c *lru) peek(key string) (interface{}, bool) {
+	elem, ok := c.data[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*cacheItem)
+	if c.expired(item) {
+		return nil, false
+	}
+	return resolve(item.value)
+}
+
+// computation is a GetOrCompute call producing the value for a key. Done
+// is closed once value and err are set.
+type computation struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// getOrCompute implements GetOrCompute on top of the cache's own get and
+// set. The value is only stored if compute returns no error.
+func (c *lru) getOrCompute(key string, compute func() (interface{}, error),
+	get func(key string) (interface{}, bool), set func(key string, value interface{})) (interface{}, error) {
+	if value, ok := get(key); ok {
+		return value, nil
+	}
+	c.mu.Lock()
+	// Another caller may have stored the value after get missed.
+	if value, ok := c.peek(key); ok {
+		c.mu.Unlock()
+		return value, nil
+	}
+	if running, ok := c.computing[key]; ok {
+		c.mu.Unlock()
+		<-running.done
+		return running.value, running.err
+	}
+	if c.computing == nil {
+		c.computing = make(map[string]*computation)
+	}
+	running := &computation{done: make(chan struct{})}
+	c.computing[key] = running
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.computing, key)
+		c.mu.Unlock()
+		close(running.done)
+	}()
+	running.value, running.err = compute()
+	if running.err != nil {
+		running.value = nil
+		return nil, running.err
+	}
+	set(key, running.value)
+	return running.value, nil
+}
+
+// NumBackgroundGoroutines returns the number of goroutines the cache is
+// currently running in the background.
+func (c *lru) NumBackgroundGoroutines() int {
+	return c.background.count()
+}
+
+// Close stops every goroutine the cache runs in the background.
+func (c *lru) Close() {
+	c.mu.Lock()
+	c.closed = true
+	if c.sampler != nil {
+		c.sampler.stop()
+	}
+	c.mu.Unlock()
+	c.background.stop()
+}
+
+// time returns the cache's clock. The caller must hold c.mu.
+func (c *lru) time() clock {
+	if c.clock == nil {
+		return realClock{}
+	}
+	return c.clock
+}
+
+// SetMergeFunc makes Set combine the value it is given with the one
+// already stored under the key, storing merge(old, new) instead of
+// replacing it. merge is not called when the key is absent, and is called
+// with the cache locked, so it must not call back into the cache.
+func (c *lru) SetMergeFunc(merge func(old, new interface{}) interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.merge = merge
+}
+
+// update stores value into item, merging it with the old value if a merge
+// function is configured, and returns the stored value. A replaced value
+// is released; a merged one is not, since the entry lives on. The caller
+// must hold c.mu.
+func (c *lru) update(item *cacheItem, value interface{}) interface{} {
+	if c.merge != nil {
+		value = c.merge(item.value, value)
+	} else {
+		c.release(item)
+	}
+	item.value = value
+	item.expires, item.ttl = time.Time{}, 0
+	c.unscheduleExpiry(item)
+	if p, ok := c.policy.(UpdatePolicy); ok {
+		p.RecordUpdate(item.key)
+	}
+	c.measure(item)
+	return value
+}
+
+// upsert calls store with merge(old, value) if key is cached and with
+// value otherwise, using merge in place of the one set by SetMergeFunc.
+// The caller must hold c.mu.
+func (c *lru) upsert(key string, value interface{}, merge func(old, new interface{}) interface{}, store func(value interface{})) {
+	saved := c.merge
+	if old, ok := c.peek(key); ok {
+		value = merge(old, value)
+		// The entry lives on, so update must keep it rather than release
+		// it.
+		c.merge = func(_, merged interface{}) interface{} { return merged }
+	} else {
+		c.merge = nil
+	}
+	store(value)
+	c.merge = saved
+}
+
+// SetMaxSize bounds the total size of the entries, as measured by sizer,
+// to maxSize, on top of the bound on their number. Entries are evicted
+// from the least recently used on until both bounds hold, starting with
+// the next Set. A nil sizer removes the bound on size. A SimpleCache does
+// not keep a value larger than maxSize on its own: storing one evicts it
+// and leaves the other entries alone.
+func (c *lru) SetMaxSize(maxSize int, sizer func(value interface{}) int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sizer = sizer
+	c.maxSize = maxSize
+	c.size = 0
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*cacheItem)
+		item.size = 0
+		c.measure(item)
+	}
+}
+
+// Size returns the total size of the entries as measured by the sizer
+// given to SetMaxSize, or 0 if there is none.
+func (c *lru) Size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.size
+}
+
+// measure updates the size of item after its value changed. The caller
+// must hold c.mu.
+func (c *lru) measure(item *cacheItem) {
+	if c.sizer == nil {
+		return
+	}
+	value, _ := resolve(item.value)
+	n := c.sizer(value)
+	c.size += n - item.size
+	item.size = n
+}
+
+// expireAfter makes item expire once ttl has elapsed. The caller must
+// hold c.mu.
+func (c *lru) expireAfter(item *cacheItem, ttl time.Duration) {
+	if ttl > 0 {
+		item.expires, item.ttl = c.time().Now().Add(ttl), ttl
+		c.scheduleExpiry(item)
+	}
+}
+
+// expired reports whether item has expired. The caller must hold c.mu,
+// at least for reading.
+func (c *lru) expired(item *cacheItem) bool {
+	return !item.expires.IsZero() && !c.time().Now().Before(item.expires)
+}
+
+// expire removes item if it has expired, and reports whether it did. The
+// caller must hold c.mu.
+func (c *lru) expire(item *cacheItem) bool {
+	if !c.expired(item) {
+		return false
+	}
+	c.remove(item.key)
+	c.departed(item.key, Expired)
+	return true
+}
+
+// release schedules the cleanup of an item whose value is leaving the
+// cache. The caller must hold c.mu.
+func (c *lru) release(item *cacheItem) {
+	if item.cleanup == nil {
+		return
+	}
+	cleanup := item.cleanup
+	value, _ := resolve(item.value)
+	item.cleanup = nil
+	c.released = append(c.released, func() { cleanup(value) })
+}
+
+// SetOnEvict makes the cache call onEvict with every entry it drops to
+// stay within capacity. onEvict is called without the cache locked, after
+// the entry's cleanup, if any. A nil onEvict turns the notification off.
+func (c *lru) SetOnEvict(onEvict func(key string, value interface{})) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onEvict = onEvict
+}
+
+// SetSizeReporter makes the cache call report with its number of entries
+// after every everyN Set or Delete calls. report is called without the
+// cache locked. everyN <= 0 turns reporting off.
+func (c *lru) SetSizeReporter(everyN int, report func(size int)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if everyN <= 0 || report == nil {
+		c.reportEvery = 0
+		c.reportSize = nil
+		return
+	}
+	c.nrMutations = 0
+	c.reportEvery = uint64(everyN)
+	c.reportSize = report
+}
+
+// mutated counts a Set or Delete. If a size report is due, unlock sends
+// it. The caller must hold c.mu and release it with unlock.
+func (c *lru) mutated() {
+	if c.reportEvery == 0 {
+		return
+	}
+	c.nrMutations++
+	if c.nrMutations%c.reportEvery == 0 {
+		c.reportDue = true
+	}
+}
+
+// unlock releases c.mu, then runs the cleanups and reports scheduled
+// while it was held.
+func (c *lru) unlock() {
+	runAll(c.unlockLater())
+}
+
+// unlockLater is like unlock, but returns the cleanups and reports instead
+// of running them, for a caller that holds other locks they must not run
+// under.
+func (c *lru) unlockLater() []func() {
+	if c.reportDue {
+		c.reportDue = false
+		report, size := c.reportSize, len(c.data)
+		c.released = append(c.released, func() { report(size) })
+	}
+	released := c.released
+	c.released = nil
+	c.mu.Unlock()
+	return released
+}
+
+func runAll(fs []func()) {
+	for _, f := range fs {
+		f()
+	}
+}
+
+// now returns the sequence number of an access happening now.
+func (c *lru) now() uint64 {
+	return c.lastSeq + 1
+}
+
+// reorder records an access to elem at seq and moves it to its place in
+// the list. The caller must hold c.mu.
+func (c *lru) reorder(elem *list.Element, seq uint64) {
+	item := elem.Value.(*cacheItem)
+	item.seq = seq
+	item.accessed = 0
+	if seq > c.lastSeq {
+		c.lastSeq = seq
+		c.list.MoveToFront(elem)
+		return
+	}
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		if e != elem && e.Value.(*cacheItem).seq <= seq {
+			c.list.MoveBefore(elem, e)
+			return
+		}
+	}
+	c.list.MoveToBack(elem)
+}
+
+// settle moves elem to its place if a read-locked Get accessed it since it
+// was last moved. The caller must hold c.mu.
+func (c *lru) settle(elem *list.Element) {
+	if item := elem.Value.(*cacheItem); item.accessed > item.seq {
+		c.reorder(elem, item.accessed)
+	}
+}
+
+// settleAll puts the whole list in order. The caller must hold c.mu.
+func (c *lru) settleAll() {
+	var unsettled []*list.Element
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		if item := e.Value.(*cacheItem); item.accessed > item.seq {
+			unsettled = append(unsettled, e)
+		}
+	}
+	for _, e := range unsettled {
+		c.settle(e)
+	}
+}
+
+// getShared is the part of Get that only needs c.mu read-locked: it finds
+// a live item and records the access without moving it. ok is false when
+// the Get needs the write lock instead; a miss is left to the caller.
+func (c *lru) getShared(key string) (value interface{}, found, ok bool) {
+	if c.agingInterval > 0 || c.policy != nil {
+		return nil, false, false
+	}
+	elem, found := c.data[key]
+	if !found {
+		return nil, false, true
+	}
+	item := elem.Value.(*cacheItem)
+	if c.expired(item) {
+		return nil, false, false
+	}
+	if value, ok = resolve(item.value); !ok {
+		return nil, false, false
+	}
+	seq := atomic.AddUint64(&c.lastSeq, 1)
+	for {
+		accessed := atomic.LoadUint64(&item.accessed)
+		if accessed >= seq || atomic.CompareAndSwapUint64(&item.accessed, accessed, seq) {
+			break
+		}
+	}
+	atomic.AddUint64(&c.hits, 1)
+	atomic.StoreInt64(&item.lastAccess, c.time().Now().UnixNano())
+	for {
+		hits := atomic.LoadUint64(&item.hits)
+		if hits == math.MaxUint64 || atomic.CompareAndSwapUint64(&item.hits, hits, hits+1) {
+			break
+		}
+	}
+	return value, true, true
+}
+
+// lookup returns the item stored under key and records an access to it at
+// seq. The caller must hold c.mu.
+func (c *lru) lookup(key string, seq uint64) (*cacheItem, bool) {
+	if elem, ok := c.data[key]; ok {
+		c.reorder(elem, seq)
+		return elem.Value.(*cacheItem), true
+	}
+	return nil, false
+}
+
+// Touch marks key as the most recently used, like Get but without
+// returning its value or counting as a hit. If the entry was set with an
+// expiry, it gets its whole ttl again. Touch reports whether key is
+// cached.
+func (c *lru) Touch(key string) bool {
+	c.mu.Lock()
+	defer c.unlock()
+	item, ok := c.lookup(key, c.now())
+	if !ok || c.expire(item) {
+		return false
+	}
+	if _, ok := resolve(item.value); !ok {
+		c.remove(key)
+		c.departed(key, Evicted)
+		return false
+	}
+	if c.policy != nil {
+		c.agePolicy()
+		c.policy.RecordAccess(key)
+	}
+	c.expireAfter(item, item.ttl)
+	return true
+}
+
+// refreshIfExpiring makes the entry under key expire after newTTL if it
+// expires within window. The caller must hold c.mu.
+func (c *lru) refreshIfExpiring(key string, window, newTTL time.Duration) {
+	elem, ok := c.data[key]
+	if !ok {
+		return
+	}
+	item := elem.Value.(*cacheItem)
+	if !item.expires.IsZero() && item.expires.Sub(c.time().Now()) <= window {
+		c.expireAfter(item, newTTL)
+	}
+}
+
+// hit counts a Get that found item. The caller must hold c.mu.
+func (c *lru) hit(item *cacheItem) {
+	atomic.AddUint64(&c.hits, 1)
+	item.lastAccess = c.time().Now().UnixNano()
+	c.observe(hitEvent, item.key)
+	if c.policy != nil {
+		c.agePolicy()
+		c.policy.RecordAccess(item.key)
+	}
+	c.age(item)
+	if item.hits < math.MaxUint64 {
+		item.hits++
+	}
+}
+
+// SetAccessCountAging makes the access count of every entry halve once
+// per interval, so that entries which were hot long ago do not outrank
+// entries which are hot now. interval <= 0 turns aging off.
+func (c *lru) SetAccessCountAging(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Settle the counts under the old interval before restarting epochs.
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		c.age(e.Value.(*cacheItem))
+	}
+	c.agePolicy()
+	c.agingInterval = interval
+	c.agingStart = c.time().Now()
+	c.policyEpoch = 0
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		e.Value.(*cacheItem).epoch = 0
+	}
+}
+
+// epoch returns the number of aging intervals elapsed. The caller must
+// hold c.mu.
+func (c *lru) epoch() uint64 {
+	if c.agingInterval <= 0 {
+		return 0
+	}
+	return uint64(c.time().Now().Sub(c.agingStart) / c.agingInterval)
+}
+
+// age halves item's access count once for every aging interval since it
+// was last aged. The caller must hold c.mu.
+func (c *lru) age(item *cacheItem) {
+	epoch := c.epoch()
+	if epoch <= item.epoch {
+		return
+	}
+	if shift := epoch - item.epoch; shift < 64 {
+		item.hits >>= shift
+	} else {
+		item.hits = 0
+	}
+	item.epoch = epoch
+}
+
+// insert stores a new item for key, accessed at seq. A cache of capacity 0
+// stores nothing and returns an item that is not in the cache. The caller
+// must hold c.mu and ensure key is not already present.
+func (c *lru) insert(key string, value interface{}, seq uint64) *cacheItem {
+	if c.capacity == 0 {
+		// Nothing is cached. The item is only for the caller to set up.
+		return &cacheItem{key: key, value: value}
+	}
+	if c.data == nil {
+		size := c.capacity
+		if size < 0 || size > maxPreallocation {
+			size = maxPreallocation
+		}
+		c.data = make(map[string]*list.Element, size)
+	}
+	now := c.time().Now()
+	item := &cacheItem{key: key, value: value, created: now, lastAccess: now.UnixNano(), epoch: c.epoch()}
+	elem := c.list.PushFront(item)
+	c.data[key] = elem
+	c.reorder(elem, seq)
+	c.measure(item)
+	if c.policy != nil {
+		c.agePolicy()
+		c.policy.RecordInsert(key)
+	}
+	if c.departures != nil {
+		c.departures.forget(key)
+	}
+	return item
+}
+
+// setCleanup registers cleanup on item. If the cache did not store item,
+// because its capacity is 0 or item is too large, cleanup runs right
+// away. The caller must hold c.mu.
+func (c *lru) setCleanup(item *cacheItem, cleanup func(value interface{})) {
+	item.cleanup = cleanup
+	if elem, ok := c.data[item.key]; !ok || elem.Value != item {
+		c.release(item)
+	}
+}
+
+// rejectOversized evicts item if its size alone exceeds the bound set by
+// SetMaxSize, rather than evicting every other entry to make room for it
+// first. The caller must hold c.mu.
+func (c *lru) rejectOversized(item *cacheItem) {
+	if c.sizer == nil || item.size <= c.maxSize {
+		return
+	}
+	if elem, ok := c.data[item.key]; ok && elem.Value == item {
+		c.untrack(item.key)
+		c.evictElement(elem)
+	}
+}
+
+// remove drops key from the cache. The caller must hold c.mu.
+func (c *lru) remove(key string) (*cacheItem, bool) {
+	if elem, ok := c.data[key]; ok {
+		c.list.Remove(elem)
+		delete(c.data, key)
+		item := elem.Value.(*cacheItem)
+		c.release(item)
+		c.size -= item.size
+		c.untrack(key)
+		c.unscheduleExpiry(item)
+		return item, true
+	}
+	return nil, false
+}
+
+// orderingSnapshot describes the entries from most to least recently
+// used. The caller must hold c.mu.
+func (c *lru) orderingSnapshot() []KeyMeta {
+	c.settleAll()
+	now := c.time().Now()
+	metas := make([]KeyMeta, 0, len(c.data))
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*cacheItem)
+		c.age(item)
+		metas = append(metas, KeyMeta{
+			Key:         item.key,
+			Age:         now.Sub(item.created),
+			AccessCount: item.hits,
+			Dirty:       item.dirty,
+		})
+	}
+	return metas
+}
+
+// drain empties the cache and returns everything it held. Entries are
+// handed over rather than released, so their cleanups do not run. The
+// caller must hold c.mu.
+func (c *lru) drain() map[string]interface{} {
+	entries := make(map[string]interface{}, len(c.data))
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*cacheItem)
+		if value, ok := resolve(item.value); ok {
+			entries[item.key] = value
+		}
+		c.untrack(item.key)
+	}
+	c.data = nil
+	c.list.Init()
+	c.size = 0
+	c.resetExpiries()
+	return entries
+}
+
+// clear removes every entry, running their cleanups. The caller must hold
+// c.mu.
+func (c *lru) clear() {
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*cacheItem)
+		c.release(item)
+		c.departed(item.key, Deleted)
+		c.untrack(item.key)
+	}
+	c.data = nil
+	c.list.Init()
+	c.size = 0
+	c.resetExpiries()
+}
+
+// removeFunc removes every entry for which match returns true, as if it
+// was deleted, and returns their keys. The caller must hold c.mu.
+func (c *lru) removeFunc(match func(key string, value interface{}) bool) []string {
+	var removed []string
+	var next *list.Element
+	for e := c.list.Front(); e != nil; e = next {
+		next = e.Next()
+		item := e.Value.(*cacheItem)
+		if c.expired(item) {
+			continue
+		}
+		if value, ok := resolve(item.value); ok && match(item.key, value) {
+			c.remove(item.key)
+			c.departed(item.key, Deleted)
+			c.observe(deleteEvent, item.key)
+			removed = append(removed, item.key)
+		}
+	}
+	return removed
+}
+
+// extractHottest removes the k most recently used entries and returns
+// them, most recent first. Like drain, it does not run cleanups. The
+// caller must hold c.mu.
+func (c *lru) extractHottest(k int) []Entry {
+	c.settleAll()
+	var entries []Entry
+	for len(entries) < k && c.list.Len() > 0 {
+		item := c.list.Remove(c.list.Front()).(*cacheItem)
+		delete(c.data, item.key)
+		c.size -= item.size
+		c.untrack(item.key)
+		c.unscheduleExpiry(item)
+		if value, ok := resolve(item.value); ok {
+			entries = append(entries, Entry{Key: item.key, Value: value})
+		}
+	}
+	return entries
+}
+
+// snapshot returns every entry, most recently used first. The caller must
+// hold c.mu.
+func (c *lru) snapshot() []Entry {
+	c.settleAll()
+	entries := make([]Entry, 0, len(c.data))
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*cacheItem)
+		if value, ok := resolve(item.value); ok {
+			entries = append(entries, Entry{Key: item.key, Value: value})
+		}
+	}
+	return entries
+}
+
+// restore stores entries as if they were set from the last to the first,
+// so that the first ends up the most recently used. The caller must hold
+// c.mu and enforce the capacity afterwards.
+func (c *lru) restore(entries []Entry) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		key, value, seq := entries[i].Key, entries[i].Value, c.now()
+		if item, ok := c.lookup(key, seq); ok {
+			c.update(item, value)
+		} else {
+			c.insert(key, value, seq)
+		}
+	}
+}
+
+// overCapacity reports whether the cache holds more entries, or larger
+// ones, than it may. The caller must hold c.mu.
+func (c *lru) overCapacity() bool {
+	if c.capacity >= 0 && len(c.data) > c.capacity {
+		return true
+	}
+	return c.sizer != nil && c.size > c.maxSize && len(c.data) > 0
+}
+
+// full reports whether a new entry could only be stored by evicting
+// another one to stay within capacity. The caller must hold c.mu.
+func (c *lru) full() bool {
+	return c.capacity >= 0 && len(c.data) >= c.capacity
+}
+
+// shrink evicts items until the cache is within capacity. The caller must
+// hold c.mu.
+func (c *lru) shrink() {
+	for c.evict() != nil {
+	}
+}
+
+// evict drops the item chosen by the eviction policy, by default the least
+// recently used, if the cache is over capacity and returns it. The caller
+// must hold c.mu.
+func (c *lru) evict() *cacheItem {
+	if !c.overCapacity() {
+		return nil
+	}
+	return c.evictElement(c.victim())
+}
+
+// evictElement drops elem as evicted and returns its item. The caller
+// must hold c.mu.
+func (c *lru) evictElement(elem *list.Element) *cacheItem {
+	item := elem.Value.(*cacheItem)
+	c.list.Remove(elem)
+	delete(c.data, item.key)
+	c.release(item)
+	c.size -= item.size
+	c.unscheduleExpiry(item)
+	atomic.AddUint64(&c.evictions, 1)
+	c.departed(item.key, Evicted)
+	c.observe(evictEvent, item.key)
+	if onEvict := c.onEvict; onEvict != nil {
+		key := item.key
+		value, _ := resolve(item.value)
+		c.released = append(c.released, func() { onEvict(key, value) })
+	}
+	return item
+}
+
+// MissReason tells why GetWithReason did not find a key.
+type MissReason int
+
+const (
+	// NotMissed is reported when the key was found.
+	NotMissed MissReason = iota
+	// NeverSet is reported for keys that were never stored, or that left
+	// the cache too long ago to still be remembered.
+	NeverSet
+	// Evicted is reported for keys dropped to stay within capacity.
+	Evicted
+	// Expired is reported for keys whose time to live ran out.
+	Expired
+	// Deleted is reported for keys removed by Delete.
+	Deleted
+)
+
+func (r MissReason) String() string {
+	switch r {
+	case NotMissed:
+		return "not missed"
+	case NeverSet:
+		return "never set"
+	case Evicted:
+		return "evicted"
+	case Expired:
+		return "expired"
+	case Deleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// departureLog remembers the reason the last few removed keys left the
+// cache, forgetting the oldest once it holds more than max keys.
+type departureLog struct {
+	max     int
+	reasons map[string]*list.Element
+	order   list.List
+}
+
+type departure struct {
+	key    string
+	reason MissReason
+}
+
+func (l *departureLog) record(key string, reason MissReason) {
+	l.forget(key)
+	l.reasons[key] = l.order.PushFront(&departure{key: key, reason: reason})
+	if l.order.Len() > l.max {
+		last := l.order.Back()
+		l.order.Remove(last)
+		delete(l.reasons, last.Value.(*departure).key)
+	}
+}
+
+func (l *departureLog) forget(key string) {
+	if elem, ok := l.reasons[key]; ok {
+		l.order.Remove(elem)
+		delete(l.reasons, key)
+	}
+}
+
+// TrackMissReasons makes the cache remember why each of the last n
+// removed keys left it, so that GetWithReason can report it. The record
+// costs memory for up to n keys; n <= 0 turns tracking off.
+func (c *lru) TrackMissReasons(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n <= 0 {
+		c.departures = nil
+		return
+	}
+	c.departures = &departureLog{max: n, reasons: make(map[string]*list.Element)}
+}
+
+// departed records that key left the cache for reason. The caller must
+// hold c.mu.
+func (c *lru) departed(key string, reason MissReason) {
+	if c.departures != nil {
+		c.departures.record(key, reason)
+	}
+}
+
+// missReason tells why key is not in the cache. The caller must hold
+// c.mu.
+func (c *lru) missReason(key string) MissReason {
+	if c.departures != nil {
+		if elem, ok := c.departures.reasons[key]; ok {
+			return elem.Value.(*departure).reason
+		}
+	}
+	return NeverSet
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Metric names used by WriteMetrics.
+const (
+	metricHits      = "cache2_hits_total"
+	metricMisses    = "cache2_misses_total"
+	metricEvictions = "cache2_evictions_total"
+	metricFlushes   = "cache2_flushes_total"
+	metricDirty     = "cache2_dirty_entries"
+	metricEntries   = "cache2_entries"
+)
+
+// Stats holds a cache's counters since it was created or since the last
+// call to ResetStats.
+type Stats struct {
+	// Hits and Misses count Get calls that did and did not find the key.
+	Hits, Misses uint64
+	// Evictions counts entries dropped to stay within capacity.
+	Evictions uint64
+	// Flushes counts runs of Flush, and Flushed the entries they wrote.
+	// Both are always 0 for a SimpleCache.
+	Flushes, Flushed uint64
+	// Len is the number of entries when Stats was called. ResetStats
+	// leaves it alone.
+	Len uint64
+}
+
+// Stats returns the cache's counters.
+func (c *SimpleCache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Hits: c.hits, Misses: c.misses, Evictions: c.evictions, Len: uint64(len(c.data))}
+}
+
+// ResetStats sets every counter returned by Stats to 0.
+func (c *SimpleCache) ResetStats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resetCounters()
+}
+
+// Stats returns the cache's counters.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Flushes:   c.flushes,
+		Flushed:   c.flushed,
+		Len:       uint64(len(c.data)),
+	}
+}
+
+// ResetStats sets every counter returned by Stats to 0.
+func (c *Cache) ResetStats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resetCounters()
+	atomic.StoreUint64(&c.flushes, 0)
+	atomic.StoreUint64(&c.flushed, 0)
+}
+
+// HitCount returns the number of Get calls that found the key. Like the
+// other counters, it is read without locking the cache, so it can be
+// scraped as often as needed without slowing down Get and Set.
+func (c *lru) HitCount() uint64 {
+	return atomic.LoadUint64(&c.hits)
+}
+
+// MissCount returns the number of Get calls that did not find the key.
+func (c *lru) MissCount() uint64 {
+	return atomic.LoadUint64(&c.misses)
+}
+
+// EvictionCount returns the number of entries dropped to stay within
+// capacity.
+func (c *lru) EvictionCount() uint64 {
+	return atomic.LoadUint64(&c.evictions)
+}
+
+// FlushCount returns the number of runs of Flush.
+func (c *Cache) FlushCount() uint64 {
+	return atomic.LoadUint64(&c.flushes)
+}
+
+// resetCounters sets the counters of lru to 0. The caller must hold c.mu.
+func (c *lru) resetCounters() {
+	atomic.StoreUint64(&c.hits, 0)
+	atomic.StoreUint64(&c.misses, 0)
+	atomic.StoreUint64(&c.evictions, 0)
+}
+
+type metric struct {
+	name  string
+	help  string
+	typ   string
+	value uint64
+}
+
+func writeMetrics(w io.Writer, metrics []metric) error {
+	for _, m := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n",
+			m.name, m.help, m.name, m.typ, m.name, m.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteMetrics writes the cache's counters and gauges to w in the
+// Prometheus text exposition format. The counters are read atomically and
+// the gauges under the read lock, so scraping does not hold up Get and Set.
+func (c *SimpleCache) WriteMetrics(w io.Writer) error {
+	c.mu.RLock()
+	entries := uint64(len(c.data))
+	c.mu.RUnlock()
+	metrics := []metric{
+		{metricHits, "Number of Get calls that found the key.", "counter", c.HitCount()},
+		{metricMisses, "Number of Get calls that did not find the key.", "counter", c.MissCount()},
+		{metricEvictions, "Number of entries evicted to stay within capacity.", "counter", c.EvictionCount()},
+		{metricEntries, "Number of entries resident in the cache.", "gauge", entries},
+	}
+	return writeMetrics(w, metrics)
+}
+
+// WriteMetrics writes the cache's counters and gauges to w in the
+// Prometheus text exposition format. The counters are read atomically and
+// the gauges under the read lock, so scraping does not hold up Get and Set.
+func (c *Cache) WriteMetrics(w io.Writer) error {
+	c.mu.RLock()
+	dirty, entries := uint64(c.dirtyList.Len()), uint64(len(c.data))
+	c.mu.RUnlock()
+	metrics := []metric{
+		{metricHits, "Number of Get calls that found the key.", "counter", c.HitCount()},
+		{metricMisses, "Number of Get calls that did not find the key.", "counter", c.MissCount()},
+		{metricEvictions, "Number of entries evicted to stay within capacity.", "counter", c.EvictionCount()},
+		{metricFlushes, "Number of times the dirty list was flushed.", "counter", c.FlushCount()},
+		{metricDirty, "Number of modifications waiting to be flushed.", "gauge", dirty},
+		{metricEntries, "Number of entries resident in the cache.", "gauge", entries},
+	}
+	return writeMetrics(w, metrics)
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	helpLine   = regexp.MustCompile(`^# HELP ([a-zA-Z_:][a-zA-Z0-9_:]*) .+$`)
+	typeLine   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge)$`)
+	sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*) ([0-9]+)$`)
+)
+
+// parseExposition checks that text is well formed exposition format and
+// returns the sample values keyed by metric name.
+func parseExposition(t *testing.T, text string) map[string]uint64 {
+	samples := make(map[string]uint64)
+	typed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if helpLine.MatchString(line) {
+			continue
+		}
+		if m := typeLine.FindStringSubmatch(line); m != nil {
+			typed[m[1]] = true
+			continue
+		}
+		m := sampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("malformed line %q", line)
+		}
+		if !typed[m[1]] {
+			t.Errorf("sample %v has no TYPE line", m[1])
+		}
+		v, err := strconv.ParseUint(m[2], 10, 64)
+		if err != nil {
+			t.Fatalf("bad value in %q: %v", line, err)
+		}
+		samples[m[1]] = v
+	}
+	return samples
+}
+
+func expectMetric(t *testing.T, samples map[string]uint64, name string, expected uint64) {
+	if v, ok := samples[name]; !ok {
+		t.Errorf("metric %v missing", name)
+	} else if v != expected {
+		t.Errorf("metric %v should be %v. Got %v", name, expected, v)
+	}
+}
+
+func TestSimpleCacheWriteMetrics(t *testing.T) {
+	c := NewSimple(2)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+	c.Get("key3")
+	c.Get("key1")
+
+	var buf bytes.Buffer
+	if err := c.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	samples := parseExposition(t, buf.String())
+	expectMetric(t, samples, "cache2_hits_total", 1)
+	expectMetric(t, samples, "cache2_misses_total", 1)
+	expectMetric(t, samples, "cache2_evictions_total", 1)
+	expectMetric(t, samples, "cache2_entries", 2)
+}
+
+func TestCacheWriteMetrics(t *testing.T) {
+	c := New(2, -1, 0*time.Second, newMemFlusher())
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Flush()
+	c.Set("key3", "3")
+	c.Get("key2")
+	c.Get("key1")
+
+	var buf bytes.Buffer
+	if err := c.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	samples := parseExposition(t, buf.String())
+	expectMetric(t, samples, "cache2_hits_total", 1)
+	expectMetric(t, samples, "cache2_misses_total", 1)
+	expectMetric(t, samples, "cache2_evictions_total", 1)
+	expectMetric(t, samples, "cache2_flushes_total", 1)
+	expectMetric(t, samples, "cache2_dirty_entries", 1)
+	expectMetric(t, samples, "cache2_entries", 2)
+}
+
+func TestStats(t *testing.T) {
+	s := NewSimple(2)
+	s.Set("key1", "1")
+	s.Set("key2", "2")
+	s.Set("key3", "3")
+	s.Get("key1")
+	s.Get("key2")
+	s.Get("key3")
+	s.Get("notexist")
+	if st := s.Stats(); st != (Stats{Hits: 2, Misses: 2, Evictions: 1, Len: 2}) {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	s.ResetStats()
+	if st := s.Stats(); st != (Stats{Len: 2}) {
+		t.Errorf("ResetStats should clear every counter. Got %+v", st)
+	}
+
+	c := New(2, -1, 0*time.Second, newMemFlusher())
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+	c.Get("key3")
+	c.Get("key1")
+	c.Flush()
+	c.Flush()
+	if st := c.Stats(); st != (Stats{Hits: 1, Misses: 1, Evictions: 1, Flushes: 2, Flushed: 3, Len: 2}) {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	c.ResetStats()
+	if st := c.Stats(); st != (Stats{Len: 2}) {
+		t.Errorf("ResetStats should clear every counter. Got %+v", st)
+	}
+}
+
+func TestCountersReadWhileAccessed(t *testing.T) {
+	c := New(10, -1, 0*time.Second, newMemFlusher())
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Get(strconv.Itoa(i % 20))
+				if i%100 == 0 {
+					c.Set(strconv.Itoa(10+g), i)
+				}
+			}
+		}(g)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			c.HitCount()
+			c.MissCount()
+			c.EvictionCount()
+			c.FlushCount()
+		}
+	}()
+	wg.Wait()
+	<-done
+	if n := c.HitCount() + c.MissCount(); n != 4000 {
+		t.Errorf("every Get should be counted. Got %v", n)
+	}
+	if c.EvictionCount() == 0 {
+		t.Errorf("Sets past the capacity should evict")
+	}
+	c.Flush()
+	if n := c.FlushCount(); n != 1 {
+		t.Errorf("should count 1 flush. Got %v", n)
+	}
+}
+
+// gaugeFunc has the shape of a prometheus.GaugeFunc: a named metric whose
+// value is read from a function at scrape time.
+type gaugeFunc struct {
+	name  string
+	value func() float64
+}
+
+// The count accessors read atomically, so they can back metrics that are
+// collected on every scrape. With the Prometheus client, register each one
+// as prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name}, value), or
+// as a CounterFunc.
+func ExampleCache_HitCount() {
+	c := New(10, -1, 0*time.Second, newMemFlusher())
+	gauges := []gaugeFunc{
+		{"cache2_hits_total", func() float64 { return float64(c.HitCount()) }},
+		{"cache2_misses_total", func() float64 { return float64(c.MissCount()) }},
+		{"cache2_evictions_total", func() float64 { return float64(c.EvictionCount()) }},
+		{"cache2_flushes_total", func() float64 { return float64(c.FlushCount()) }},
+	}
+
+	c.Set("key1", "1")
+	c.Get("key1")
+	c.Get("key2")
+	c.Flush()
+
+	for _, g := range gauges {
+		fmt.Println(g.name, g.value())
+	}
+	// Output:
+	// cache2_hits_total 1
+	// cache2_misses_total 1
+	// cache2_evictions_total 0
+	// cache2_flushes_total 1
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"container/list"
+	"sync"
+)
+
+// MultiCache is an LRU cache that holds several values per key. Capacity
+// and recency apply to individual values across the whole cache, so
+// evicting makes room by dropping the least recently used value, not a
+// whole key.
+type MultiCache struct {
+	mu       sync.Mutex
+	data     map[string][]*list.Element
+	list     list.List
+	capacity int
+}
+
+// NewMulti creates a MultiCache holding at most capacity values.
+// capacity < 0 means always in memory.
+func NewMulti(capacity int) *MultiCache {
+	return &MultiCache{
+		data:     make(map[string][]*list.Element),
+		capacity: capacity,
+	}
+}
+
+// Len returns the number of values in the cache.
+func (c *MultiCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.list.Len()
+}
+
+// Add appends value to the values stored under key.
+func (c *MultiCache) Add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[key] = append(c.data[key], c.list.PushFront(&cacheItem{key: key, value: value}))
+	if c.capacity >= 0 && c.list.Len() > c.capacity {
+		c.removeElement(c.list.Back())
+	}
+}
+
+// GetAll returns the values stored under key in the order they were
+// added, and marks them all recently used.
+func (c *MultiCache) GetAll(key string) []interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elems := c.data[key]
+	if len(elems) == 0 {
+		return nil
+	}
+	values := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		c.list.MoveToFront(elem)
+		values[i] = elem.Value.(*cacheItem).value
+	}
+	return values
+}
+
+// Delete removes every value stored under key and returns them.
+func (c *MultiCache) Delete(key string) []interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elems := c.data[key]
+	if len(elems) == 0 {
+		return nil
+	}
+	values := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		values[i] = c.list.Remove(elem).(*cacheItem).value
+	}
+	delete(c.data, key)
+	return values
+}
+
+// DeleteValue removes the first value under key that equals value, and
+// reports whether there was one. Values must be comparable.
+func (c *MultiCache) DeleteValue(key string, value interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, elem := range c.data[key] {
+		if elem.Value.(*cacheItem).value == value {
+			c.removeElement(elem)
+			return true
+		}
+	}
+	return false
+}
+
+// removeElement drops a single value. The caller must hold c.mu.
+func (c *MultiCache) removeElement(elem *list.Element) {
+	key := c.list.Remove(elem).(*cacheItem).key
+	elems := c.data[key]
+	for i, e := range elems {
+		if e == elem {
+			elems = append(elems[:i], elems[i+1:]...)
+			break
+		}
+	}
+	if len(elems) == 0 {
+		delete(c.data, key)
+	} else {
+		c.data[key] = elems
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import "testing"
+
+// expectValues checks the values under key without changing their
+// recency.
+func expectValues(t *testing.T, c *MultiCache, key string, expected ...interface{}) {
+	var values []interface{}
+	for _, elem := range c.data[key] {
+		values = append(values, elem.Value.(*cacheItem).value)
+	}
+	if len(values) != len(expected) {
+		t.Errorf("should be %v on key %v. Got %v", expected, key, values)
+		return
+	}
+	for i := range values {
+		if values[i] != expected[i] {
+			t.Errorf("should be %v on key %v. Got %v", expected, key, values)
+			return
+		}
+	}
+}
+
+func TestMultiCacheValues(t *testing.T) {
+	c := NewMulti(-1)
+	c.Add("key1", "a")
+	c.Add("key1", "b")
+	c.Add("key2", "c")
+	c.Add("key1", "a")
+
+	if values := c.GetAll("key1"); len(values) != 3 || values[0] != "a" || values[1] != "b" || values[2] != "a" {
+		t.Errorf("should be [a b a] on key key1. Got %v", values)
+	}
+	expectValues(t, c, "key2", "c")
+	if values := c.GetAll("notexist"); values != nil {
+		t.Errorf("Got nonexist")
+	}
+	if c.Len() != 4 {
+		t.Errorf("cache should hold 4 values. Got %v", c.Len())
+	}
+
+	if !c.DeleteValue("key1", "a") {
+		t.Errorf("cannot delete value a")
+	}
+	expectValues(t, c, "key1", "b", "a")
+	if c.DeleteValue("key1", "c") {
+		t.Errorf("deleted a value that is not under key1")
+	}
+
+	if deleted := c.Delete("key1"); len(deleted) != 2 {
+		t.Errorf("should delete 2 values. Got %v", deleted)
+	}
+	expectValues(t, c, "key1")
+	if c.Len() != 1 {
+		t.Errorf("cache should hold 1 value. Got %v", c.Len())
+	}
+}
+
+func TestMultiCacheEvictsValues(t *testing.T) {
+	c := NewMulti(4)
+	c.Add("key1", 1)
+	c.Add("key1", 2)
+	c.Add("key2", 3)
+	c.Add("key2", 4)
+	c.GetAll("key1")
+
+	// The oldest values of key2 go first, then those of key1.
+	c.Add("key3", 5)
+	expectValues(t, c, "key2", 4)
+	c.Add("key3", 6)
+	expectValues(t, c, "key2")
+	expectValues(t, c, "key1", 1, 2)
+	c.Add("key3", 7)
+	expectValues(t, c, "key1", 2)
+	expectValues(t, c, "key3", 5, 6, 7)
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import "sync/atomic"
+
+// Observer is told about what happens in a cache, for example to feed a
+// metrics system. Its methods are called without the cache locked, so
+// they may call back into the cache, in the order the events happened
+// unless they happened concurrently.
+type Observer interface {
+	// OnHit and OnMiss are called for every Get that did and did not
+	// find key.
+	OnHit(key string)
+	OnMiss(key string)
+	// OnSet is called for every Set of key.
+	OnSet(key string)
+	// OnDelete is called when Delete removes key.
+	OnDelete(key string)
+	// OnEvict is called when key is dropped to stay within capacity.
+	OnEvict(key string)
+	// OnFlush is called after every flush with the number of
+	// modifications it wrote.
+	OnFlush(n int)
+}
+
+type event int
+
+const (
+	hitEvent event = iota
+	missEvent
+	setEvent
+	deleteEvent
+	evictEvent
+)
+
+func notify(o Observer, ev event, key string) {
+	switch ev {
+	case hitEvent:
+		o.OnHit(key)
+	case missEvent:
+		o.OnMiss(key)
+	case setEvent:
+		o.OnSet(key)
+	case deleteEvent:
+		o.OnDelete(key)
+	case evictEvent:
+		o.OnEvict(key)
+	}
+}
+
+// notifyGet reports a Get of key that took the read lock only.
+func notifyGet(o Observer, key string, found bool) {
+	if found {
+		o.OnHit(key)
+	} else {
+		o.OnMiss(key)
+	}
+}
+
+// SetObserver makes the cache report its events to o. A nil o stops the
+// reporting.
+func (c *lru) SetObserver(o Observer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observer = o
+}
+
+// observe reports ev on key to the observer, if there is one, once c.mu
+// is released. The caller must hold c.mu and release it with unlock.
+func (c *lru) observe(ev event, key string) {
+	if o := c.observer; o != nil {
+		c.released = append(c.released, func() { notify(o, ev, key) })
+	}
+}
+
+// miss counts a Get that did not find key. The caller must hold c.mu.
+func (c *lru) miss(key string) {
+	atomic.AddUint64(&c.misses, 1)
+	c.observe(missEvent, key)
+}
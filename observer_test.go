@@ -0,0 +1,129 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	m      sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, args ...interface{}) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingObserver) OnHit(key string)    { o.record("hit %v", key) }
+func (o *recordingObserver) OnMiss(key string)   { o.record("miss %v", key) }
+func (o *recordingObserver) OnSet(key string)    { o.record("set %v", key) }
+func (o *recordingObserver) OnDelete(key string) { o.record("delete %v", key) }
+func (o *recordingObserver) OnEvict(key string)  { o.record("evict %v", key) }
+func (o *recordingObserver) OnFlush(n int)       { o.record("flush %v", n) }
+
+func (o *recordingObserver) String() string {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return strings.Join(o.events, ", ")
+}
+
+func TestObserver(t *testing.T) {
+	caches := []CacheInterface{NewSimple(2), New(2, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		o := new(recordingObserver)
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.SetObserver(o)
+		case *Cache:
+			c.SetObserver(o)
+		}
+		c.Set("key1", "1")
+		c.Set("key2", "2")
+		c.Get("key1")
+		c.Set("key3", "3")
+		c.Get("key2")
+		c.Delete("key3")
+		c.Delete("notexist")
+		c.Flush()
+
+		expected := "set key1, set key2, hit key1, set key3, evict key2, miss key2, delete key3"
+		if _, ok := c.(*Cache); ok {
+			expected += ", flush 3"
+		}
+		if o.String() != expected {
+			t.Errorf("events should be\n%v\nGot\n%v", expected, o)
+		}
+	}
+}
+
+func TestObserverMayCallIntoCache(t *testing.T) {
+	for _, c := range []CacheInterface{NewSimple(1), New(1, 1, 0*time.Second, newMemFlusher())} {
+		o := &reenteringObserver{c: c}
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.SetObserver(o)
+		case *Cache:
+			c.SetObserver(o)
+		}
+		done := make(chan bool)
+		go func() {
+			c.Set("key1", "1")
+			c.Set("key2", "2")
+			c.Get("key2")
+			c.Flush()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%T deadlocked in an observer callback", c)
+		}
+	}
+}
+
+// reenteringObserver reads the cache from every callback, and flushes it
+// from its first OnFlush.
+type reenteringObserver struct {
+	c         CacheInterface
+	reentered bool
+}
+
+func (o *reenteringObserver) OnHit(key string)    { o.c.Len() }
+func (o *reenteringObserver) OnMiss(key string)   { o.c.Len() }
+func (o *reenteringObserver) OnSet(key string)    { o.c.Len() }
+func (o *reenteringObserver) OnDelete(key string) { o.c.Len() }
+func (o *reenteringObserver) OnEvict(key string)  { o.c.Len() }
+
+func (o *reenteringObserver) OnFlush(n int) {
+	c, ok := o.c.(*Cache)
+	if !ok || o.reentered {
+		return
+	}
+	o.reentered = true
+	c.FlushKey("key1")
+	c.Set("key3", "3")
+	c.Flush()
+	c.Drain()
+}
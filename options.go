@@ -0,0 +1,97 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import "time"
+
+// Option configures a Cache made by NewCache.
+type Option func(*options)
+
+type options struct {
+	capacity    int
+	maxNrDirty  int
+	flushPeriod time.Duration
+	flusher     Flusher
+	onEvict     func(key string, value interface{})
+}
+
+// WithCapacity bounds the number of entries held in memory. It means as
+// for New; without it, every entry is kept in memory.
+func WithCapacity(capacity int) Option {
+	return func(o *options) { o.capacity = capacity }
+}
+
+// WithMaxDirty makes the cache flush once maxNrDirty modifications are
+// pending. It means as for New; without it, only the periodic flush and
+// Flush write to the flusher.
+func WithMaxDirty(maxNrDirty int) Option {
+	return func(o *options) { o.maxNrDirty = maxNrDirty }
+}
+
+// WithFlushPeriod makes the cache flush every flushPeriod, which must be
+// at least one second. Without it, or with 0, there is no periodic flush.
+func WithFlushPeriod(flushPeriod time.Duration) Option {
+	return func(o *options) { o.flushPeriod = flushPeriod }
+}
+
+// WithFlusher sets the flusher modifications are written to. It is
+// required.
+func WithFlusher(flusher Flusher) Option {
+	return func(o *options) { o.flusher = flusher }
+}
+
+// WithOnEvict makes the cache call onEvict like SetOnEvict.
+func WithOnEvict(onEvict func(key string, value interface{})) Option {
+	return func(o *options) { o.onEvict = onEvict }
+}
+
+// NewCache creates a Cache configured by opts. It returns ErrNilFlusher
+// without WithFlusher, and ErrFlushPeriod for a flush period shorter than
+// a second.
+func NewCache(opts ...Option) (*Cache, error) {
+	o := options{capacity: -1, maxNrDirty: -1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return newWithOptions(o), nil
+}
+
+// validate returns the error NewCache and NewWithError fail with for o.
+func (o *options) validate() error {
+	if o.flusher == nil {
+		return ErrNilFlusher
+	}
+	if o.flushPeriod != 0 && o.flushPeriod < time.Second {
+		return ErrFlushPeriod
+	}
+	return nil
+}
+
+// newWithOptions builds the Cache configured by o. o.flusher must not be
+// nil.
+func newWithOptions(o options) *Cache {
+	cache := newCache(o.capacity, o.maxNrDirty, o.flushPeriod)
+	cache.adapter.flusher = o.flusher
+	cache.flusher = &cache.adapter
+	cache.onEvict = o.onEvict
+	cache.start()
+	return cache
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewCache(t *testing.T) {
+	if _, err := NewCache(WithFlushPeriod(time.Minute)); err != ErrNilFlusher {
+		t.Errorf("a cache without flusher should be refused. Got %v", err)
+	}
+	if _, err := NewCache(WithFlusher(newMemFlusher()), WithFlushPeriod(time.Millisecond)); err != ErrFlushPeriod {
+		t.Errorf("a flush period below a second should be refused. Got %v", err)
+	}
+
+	f := newMemFlusher()
+	var evicted []string
+	c, err := NewCache(
+		WithCapacity(2),
+		WithMaxDirty(3),
+		WithFlusher(f),
+		WithOnEvict(func(key string, value interface{}) { evicted = append(evicted, key) }),
+	)
+	if err != nil {
+		t.Fatalf("NewCache should succeed. Got %v", err)
+	}
+	defer c.Close()
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+	if len(evicted) != 1 || evicted[0] != "key1" {
+		t.Errorf("key1 should be evicted. Got %v", evicted)
+	}
+	if v, _ := f.threadSafeGet("key1"); v != "1" {
+		t.Errorf("reaching 3 dirty should flush. Got %v on key1", v)
+	}
+
+	unbounded, _ := NewCache(WithFlusher(f))
+	for i := 0; i < 100; i++ {
+		unbounded.Set("key", i)
+	}
+	if n := unbounded.Cap(); n >= 0 {
+		t.Errorf("a cache should be unbounded by default. Got capacity %v", n)
+	}
+	if n := unbounded.DirtyLen(); n != 1 {
+		t.Errorf("a cache should not flush by count by default. Got %v dirty", n)
+	}
+}
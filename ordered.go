@@ -0,0 +1,192 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"container/list"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+const maxSkipLevel = 24
+
+// OrderedCache is an LRU cache that also keeps its keys sorted, so that
+// all entries within a key range can be found in O(log n + k). Keys are
+// ordered as strings.
+type OrderedCache struct {
+	mu       sync.Mutex
+	data     map[string]*orderedNode
+	list     list.List
+	capacity int
+
+	// head is the sentinel of a skip list holding every node in key
+	// order.
+	head  orderedNode
+	level int
+	rnd   *rand.Rand
+}
+
+type orderedNode struct {
+	key   string
+	value interface{}
+	elem  *list.Element
+	next  []*orderedNode
+}
+
+var _ CacheInterface = &OrderedCache{}
+
+// NewOrdered creates an OrderedCache holding at most capacity entries.
+// capacity < 0 means always in memory.
+func NewOrdered(capacity int) *OrderedCache {
+	c := &OrderedCache{
+		data:     make(map[string]*orderedNode),
+		capacity: capacity,
+		level:    1,
+		rnd:      rand.New(rand.NewSource(1)),
+	}
+	c.head.next = make([]*orderedNode, maxSkipLevel)
+	return c
+}
+
+func (c *OrderedCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.data)
+}
+
+func (c *OrderedCache) Flush() {}
+
+func (c *OrderedCache) Get(key string) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.data[key]; ok {
+		c.list.MoveToFront(n.elem)
+		return n.value
+	}
+	return nil
+}
+
+func (c *OrderedCache) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.data[key]; ok {
+		n.value = value
+		c.list.MoveToFront(n.elem)
+		return
+	}
+	n := c.insertNode(key, value)
+	n.elem = c.list.PushFront(n)
+	c.data[key] = n
+	if c.capacity >= 0 && len(c.data) > c.capacity {
+		c.removeNode(c.list.Back().Value.(*orderedNode))
+	}
+}
+
+func (c *OrderedCache) Delete(key string) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.data[key]; ok {
+		c.removeNode(n)
+		return n.value
+	}
+	return nil
+}
+
+// RangeQuery returns the entries whose keys are in [lo, hi), in key
+// order. It does not change the recency of the entries it returns.
+func (c *OrderedCache) RangeQuery(lo, hi string) []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var entries []Entry
+	for n := c.seek(lo, nil); n != nil && n.key < hi; n = n.next[0] {
+		entries = append(entries, Entry{Key: n.key, Value: n.value})
+	}
+	return entries
+}
+
+// seek returns the first node whose key is >= key. If update is not nil,
+// it is filled with the last node before that position on every level.
+func (c *OrderedCache) seek(key string, update []*orderedNode) *orderedNode {
+	x := &c.head
+	for i := c.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// insertNode links a new node for key into the skip list. key must not
+// already be present.
+func (c *OrderedCache) insertNode(key string, value interface{}) *orderedNode {
+	var update [maxSkipLevel]*orderedNode
+	c.seek(key, update[:])
+
+	level := 1
+	for level < maxSkipLevel && c.rnd.Intn(4) == 0 {
+		level++
+	}
+	for ; c.level < level; c.level++ {
+		update[c.level] = &c.head
+	}
+
+	n := &orderedNode{key: key, value: value, next: make([]*orderedNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	return n
+}
+
+// removeNode unlinks n from the skip list, the recency list and the map.
+func (c *OrderedCache) removeNode(n *orderedNode) {
+	var update [maxSkipLevel]*orderedNode
+	c.seek(n.key, update[:])
+	for i := 0; i < len(n.next); i++ {
+		update[i].next[i] = n.next[i]
+	}
+	for c.level > 1 && c.head.next[c.level-1] == nil {
+		c.level--
+	}
+	c.list.Remove(n.elem)
+	delete(c.data, n.key)
+}
+
+// String describes the cache for debugging: its number of entries, its
+// capacity and its entries in key order.
+func (c *OrderedCache) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "nr elems %v <= %v\n", c.list.Len(), c.capacity)
+	b.WriteString("-----------------elements------------\n")
+	for n := c.head.next[0]; n != nil; n = n.next[0] {
+		fmt.Fprintf(&b, "%v: %v\n", n.key, n.value)
+	}
+	b.WriteString("-------------------------------------\n")
+	return b.String()
+}
+
+func (c *OrderedCache) debug() {
+	fmt.Print(c.String())
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func expectEntryKeys(t *testing.T, entries []Entry, keys ...string) {
+	if len(entries) != len(keys) {
+		t.Errorf("should get keys %v. Got %v", keys, entries)
+		return
+	}
+	for i, e := range entries {
+		if e.Key != keys[i] {
+			t.Errorf("should get keys %v. Got %v", keys, entries)
+			return
+		}
+	}
+}
+
+func TestRangeQuery(t *testing.T) {
+	c := NewOrdered(-1)
+	for _, k := range []string{"d", "b", "a", "e", "c"} {
+		c.Set(k, k)
+	}
+
+	expectEntryKeys(t, c.RangeQuery("b", "d"), "b", "c")
+	expectEntryKeys(t, c.RangeQuery("bb", "dd"), "c", "d")
+	expectEntryKeys(t, c.RangeQuery("", "z"), "a", "b", "c", "d", "e")
+	expectEntryKeys(t, c.RangeQuery("c", "c"))
+	expectEntryKeys(t, c.RangeQuery("f", "z"))
+	expectEntryKeys(t, c.RangeQuery("d", "b"))
+
+	c.Delete("c")
+	expectEntryKeys(t, c.RangeQuery("b", "e"), "b", "d")
+	if entries := c.RangeQuery("a", "b"); len(entries) != 1 || entries[0].Value != "a" {
+		t.Errorf("should get the value of a. Got %v", entries)
+	}
+}
+
+func TestOrderedCacheEvictsLRU(t *testing.T) {
+	c := NewOrdered(3)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+	c.Get("key1")
+	c.RangeQuery("key2", "key3")
+	c.Set("key4", "4")
+
+	if v := c.Get("key2"); v != nil {
+		t.Errorf("Got %v for key2, expected least recently accessed value to be evicted", v)
+	}
+	expectEntryKeys(t, c.RangeQuery("key", "key9"), "key1", "key3", "key4")
+}
+
+func TestOrderedCacheStaysSorted(t *testing.T) {
+	c := NewOrdered(100)
+	var keys []string
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("key%03d", (i*37)%200)
+		c.Set(k, i)
+		keys = append(keys, k)
+	}
+	keys = keys[100:]
+	sort.Strings(keys)
+	expectEntryKeys(t, c.RangeQuery("", "~"), keys...)
+	if c.Len() != 100 {
+		t.Errorf("cache should hold 100 entries. Got %v", c.Len())
+	}
+}
+
+func TestOrderedCacheString(t *testing.T) {
+	c := NewOrdered(5)
+	c.Set("key2", "2")
+	c.Set("key1", "1")
+	s := c.String()
+	if !strings.Contains(s, "nr elems 2 <= 5") {
+		t.Errorf("should describe the size of the cache. Got %q", s)
+	}
+	if i, j := strings.Index(s, "key1: 1"), strings.Index(s, "key2: 2"); i < 0 || j < 0 || i > j {
+		t.Errorf("should list key1 before key2. Got %q", s)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import "sync"
+
+// packed is an LRU cache of keys and values of a single type each.
+// Entries live in one slice and are linked into the recency list by index,
+// so storing a value neither boxes it in an interface nor allocates a list
+// element.
+type packed[K comparable, V any] struct {
+	mu       sync.Mutex
+	index    map[K]int32
+	slots    []slot[K, V]
+	capacity int
+	// head and tail are the most and least recently used slots, free is
+	// the first unused slot. All are -1 when there is no such slot.
+	head, tail, free int32
+}
+
+type slot[K comparable, V any] struct {
+	key        K
+	value      V
+	prev, next int32
+}
+
+func (c *packed[K, V]) init(capacity int) {
+	size := capacity
+	if size < 0 || size > maxPreallocation {
+		size = maxPreallocation
+	}
+	c.index = make(map[K]int32, size)
+	c.capacity = capacity
+	c.head, c.tail, c.free = -1, -1, -1
+}
+
+func (c *packed[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.index)
+}
+
+func (c *packed[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i, ok := c.index[key]; ok {
+		c.unlink(i)
+		c.pushFront(i)
+		return c.slots[i].value, true
+	}
+	var zero V
+	return zero, false
+}
+
+func (c *packed[K, V]) set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i, ok := c.index[key]; ok {
+		c.slots[i].value = value
+		c.unlink(i)
+		c.pushFront(i)
+		return
+	}
+	if c.capacity == 0 {
+		return
+	}
+	if c.capacity > 0 && len(c.index) >= c.capacity {
+		c.release(c.tail)
+	}
+	var i int32
+	if c.free >= 0 {
+		i = c.free
+		c.free = c.slots[i].next
+	} else {
+		i = int32(len(c.slots))
+		c.slots = append(c.slots, slot[K, V]{})
+	}
+	c.slots[i].key = key
+	c.slots[i].value = value
+	c.index[key] = i
+	c.pushFront(i)
+}
+
+func (c *packed[K, V]) remove(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i, ok := c.index[key]; ok {
+		value := c.slots[i].value
+		c.release(i)
+		return value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// release unlinks slot i, forgets its key and puts it on the free list.
+func (c *packed[K, V]) release(i int32) {
+	c.unlink(i)
+	delete(c.index, c.slots[i].key)
+	c.slots[i] = slot[K, V]{next: c.free}
+	c.free = i
+}
+
+func (c *packed[K, V]) unlink(i int32) {
+	s := &c.slots[i]
+	if s.prev >= 0 {
+		c.slots[s.prev].next = s.next
+	} else {
+		c.head = s.next
+	}
+	if s.next >= 0 {
+		c.slots[s.next].prev = s.prev
+	} else {
+		c.tail = s.prev
+	}
+}
+
+func (c *packed[K, V]) pushFront(i int32) {
+	s := &c.slots[i]
+	s.prev = -1
+	s.next = c.head
+	if c.head >= 0 {
+		c.slots[c.head].prev = i
+	}
+	c.head = i
+	if c.tail < 0 {
+		c.tail = i
+	}
+}
+
+// Int64Cache is an LRU cache of int64 values that stores them unboxed.
+type Int64Cache struct {
+	packed[string, int64]
+}
+
+// NewInt64 creates an Int64Cache holding at most capacity entries.
+// capacity < 0 means always in memory; capacity = 0 means no cache.
+func NewInt64(capacity int) *Int64Cache {
+	c := new(Int64Cache)
+	c.init(capacity)
+	return c
+}
+
+func (c *Int64Cache) Get(key string) (int64, bool) {
+	return c.get(key)
+}
+
+func (c *Int64Cache) Set(key string, value int64) {
+	c.set(key, value)
+}
+
+func (c *Int64Cache) Delete(key string) (int64, bool) {
+	return c.remove(key)
+}
+
+// BytesCache is an LRU cache of byte slices. It keeps the slice it is
+// given, so callers must not modify a slice after storing it.
+type BytesCache struct {
+	packed[string, []byte]
+}
+
+// NewBytes creates a BytesCache holding at most capacity entries.
+// capacity < 0 means always in memory; capacity = 0 means no cache.
+func NewBytes(capacity int) *BytesCache {
+	c := new(BytesCache)
+	c.init(capacity)
+	return c
+}
+
+func (c *BytesCache) Get(key string) ([]byte, bool) {
+	return c.get(key)
+}
+
+func (c *BytesCache) Set(key string, value []byte) {
+	c.set(key, value)
+}
+
+func (c *BytesCache) Delete(key string) ([]byte, bool) {
+	return c.remove(key)
+}
+
+// TypedCache is an LRU cache with keys of type K and values of type V.
+// Like Int64Cache, it stores values without boxing them, so Get needs no
+// type assertion.
+type TypedCache[K comparable, V any] struct {
+	packed[K, V]
+}
+
+// NewTyped creates a TypedCache holding at most capacity entries.
+// capacity < 0 means always in memory; capacity = 0 means no cache.
+func NewTyped[K comparable, V any](capacity int) *TypedCache[K, V] {
+	c := new(TypedCache[K, V])
+	c.init(capacity)
+	return c
+}
+
+func (c *TypedCache[K, V]) Get(key K) (V, bool) {
+	return c.get(key)
+}
+
+func (c *TypedCache[K, V]) Set(key K, value V) {
+	c.set(key, value)
+}
+
+func (c *TypedCache[K, V]) Delete(key K) (V, bool) {
+	return c.remove(key)
+}
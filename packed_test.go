@@ -0,0 +1,188 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestInt64Cache(t *testing.T) {
+	c := NewInt64(3)
+	c.Set("key1", 1)
+	c.Set("key2", 2)
+	c.Set("key3", 3)
+	c.Get("key1")
+	c.Set("key4", 4)
+
+	if v, ok := c.Get("key2"); ok {
+		t.Errorf("Got %v for key2, expected least recently accessed value to be evicted", v)
+	}
+	for k, expected := range map[string]int64{"key1": 1, "key3": 3, "key4": 4} {
+		if v, ok := c.Get(k); !ok || v != expected {
+			t.Errorf("should be %v on key %v. Got %v", expected, k, v)
+		}
+	}
+
+	c.Set("key3", 33)
+	if v, _ := c.Get("key3"); v != 33 {
+		t.Errorf("cannot update")
+	}
+	if v, ok := c.Delete("key3"); !ok || v != 33 {
+		t.Errorf("should delete 33 on key3. Got %v", v)
+	}
+	if _, ok := c.Get("key3"); ok {
+		t.Errorf("cannot delete")
+	}
+
+	// Freed slots are reused.
+	c.Set("key5", 5)
+	c.Set("key6", 6)
+	if c.Len() != 3 || len(c.slots) != 3 {
+		t.Errorf("cache should reuse 3 slots. Got %v entries in %v slots", c.Len(), len(c.slots))
+	}
+}
+
+func TestBytesCache(t *testing.T) {
+	c := NewBytes(-1)
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i), []byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := c.Get(strconv.Itoa(i)); !ok || !bytes.Equal(v, []byte(strconv.Itoa(i))) {
+			t.Errorf("should be %v on key %v. Got %s", i, i, v)
+		}
+	}
+	if _, ok := c.Get("notexist"); ok {
+		t.Errorf("Got nonexist")
+	}
+
+	none := NewBytes(0)
+	none.Set("key1", []byte("1"))
+	if none.Len() != 0 {
+		t.Errorf("capacity 0 should store nothing")
+	}
+}
+
+func benchmarkKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func BenchmarkInt64CacheSet(b *testing.B) {
+	keys := benchmarkKeys(1024)
+	c := NewInt64(512)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Set(keys[i%len(keys)], int64(i))
+	}
+}
+
+func BenchmarkSimpleCacheSetInt64(b *testing.B) {
+	keys := benchmarkKeys(1024)
+	c := NewSimple(512)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Set(keys[i%len(keys)], int64(i))
+	}
+}
+
+func BenchmarkBytesCacheGet(b *testing.B) {
+	keys := benchmarkKeys(1024)
+	c := NewBytes(len(keys))
+	for _, k := range keys {
+		c.Set(k, []byte(k))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v, _ := c.Get(keys[i%len(keys)])
+		_ = v
+	}
+}
+
+func BenchmarkSimpleCacheGetBytes(b *testing.B) {
+	keys := benchmarkKeys(1024)
+	c := NewSimple(len(keys))
+	for _, k := range keys {
+		c.Set(k, []byte(k))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v, _ := c.Get(keys[i%len(keys)]).([]byte)
+		_ = v
+	}
+}
+
+type session struct {
+	user  string
+	admin bool
+}
+
+func TestTypedCache(t *testing.T) {
+	c := NewTyped[string, session](2)
+	c.Set("key1", session{"alice", true})
+	c.Set("key2", session{"bob", false})
+	c.Get("key1")
+	c.Set("key3", session{"carol", false})
+
+	if v, ok := c.Get("key2"); ok {
+		t.Errorf("Got %v for key2, expected least recently accessed value to be evicted", v)
+	}
+	if v, ok := c.Get("key1"); !ok || v.user != "alice" || !v.admin {
+		t.Errorf("should be alice on key1. Got %v", v)
+	}
+	if v, ok := c.Delete("key3"); !ok || v.user != "carol" {
+		t.Errorf("should delete carol on key3. Got %v", v)
+	}
+	if v, ok := c.Get("key3"); ok || v != (session{}) {
+		t.Errorf("deleted key should give the zero value. Got %v", v)
+	}
+	if c.Len() != 1 {
+		t.Errorf("cache should hold 1 entry. Got %v", c.Len())
+	}
+
+	ints := NewTyped[int, *session](-1)
+	for i := 0; i < 100; i++ {
+		ints.Set(i, &session{user: strconv.Itoa(i)})
+	}
+	if v, ok := ints.Get(42); !ok || v.user != "42" {
+		t.Errorf("should be 42 on key 42. Got %v", v)
+	}
+}
+
+func TestTypedCacheStoresZeroValues(t *testing.T) {
+	c := NewTyped[string, int](5)
+	c.Set("zero", 0)
+	if v, ok := c.Get("zero"); !ok || v != 0 {
+		t.Errorf("stored zero should be found. Got %v, %v", v, ok)
+	}
+	if _, ok := c.Get("notexist"); ok {
+		t.Errorf("absent key should not be found")
+	}
+	if v, ok := c.Delete("zero"); !ok || v != 0 {
+		t.Errorf("stored zero should be deleted. Got %v, %v", v, ok)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"io"
+)
+
+// Save writes every entry to w with encoding/gob, most recently used
+// first, for reloading with Load, e.g. after a restart. The concrete types
+// of the values must be registered with gob.Register by the caller,
+// except for the basic types such as string and []byte that gob already
+// knows.
+func (c *SimpleCache) Save(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(c.Snapshot())
+}
+
+// Load reads entries written by Save from r and stores them like Restore:
+// they keep their order, and if there are more than the cache can hold,
+// only the most recently used are kept.
+func (c *SimpleCache) Load(r io.Reader) error {
+	var entries []Entry
+	if err := gob.NewDecoder(r).Decode(&entries); err != nil {
+		return err
+	}
+	c.Restore(entries)
+	return nil
+}
+
+// MarshalJSON encodes the entries as a JSON array of {"Key", "Value"}
+// objects, most recently used first, e.g. for a debugging endpoint. It
+// fails if a value cannot be encoded as JSON.
+func (c *SimpleCache) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Snapshot())
+}
+
+// UnmarshalJSON stores the entries encoded by MarshalJSON like Restore.
+// Values come back as the types encoding/json decodes into an
+// interface{}, so strings round-trip but numbers become float64.
+func (c *SimpleCache) UnmarshalJSON(data []byte) error {
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	c.Restore(entries)
+	return nil
+}
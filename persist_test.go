@@ -0,0 +1,100 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	c := NewSimple(5)
+	c.Set("key1", "1")
+	c.Set("key2", []byte("2"))
+	c.Set("key3", "3")
+	c.Get("key1")
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	saved := buf.Bytes()
+
+	loaded := NewSimple(5)
+	if err := loaded.Load(bytes.NewReader(saved)); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if v := loaded.Get("key3"); v != "3" {
+		t.Errorf("should be 3 on key3. Got %v", v)
+	}
+	if v, _ := loaded.Get("key2").([]byte); string(v) != "2" {
+		t.Errorf("should be 2 on key2. Got %v", v)
+	}
+	expected := []string{"key2", "key3", "key1"}
+	if keys := loaded.Keys(); fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("order should be %v. Got %v", expected, keys)
+	}
+
+	// A smaller cache keeps the most recently used entries.
+	small := NewSimple(2)
+	if err := small.Load(bytes.NewReader(saved)); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	expected = []string{"key1", "key3"}
+	if keys := small.Keys(); fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("order should be %v. Got %v", expected, keys)
+	}
+
+	if err := NewSimple(5).Load(strings.NewReader("garbage")); err == nil {
+		t.Errorf("Load should fail on garbage")
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	c := NewSimple(5)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+	c.Get("key1")
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	expected := `[{"Key":"key1","Value":"1"},{"Key":"key3","Value":"3"},{"Key":"key2","Value":"2"}]`
+	if string(data) != expected {
+		t.Errorf("should encode %v. Got %s", expected, data)
+	}
+
+	loaded := NewSimple(5)
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if keys := loaded.Keys(); fmt.Sprint(keys) != "[key1 key3 key2]" {
+		t.Errorf("order should be kept. Got %v", keys)
+	}
+	expectCachedValueEquals(t, loaded, "key2", "2")
+
+	c.Set("chan", make(chan int))
+	if _, err := json.Marshal(c); err == nil {
+		t.Errorf("Marshal should fail on a value JSON cannot encode")
+	}
+}
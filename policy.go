@@ -0,0 +1,358 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// EvictionPolicy chooses which entry a cache evicts when it is over
+// capacity. Without one, a cache evicts its least recently used entry.
+//
+// The cache calls a policy with its lock held, so a policy needs no
+// locking of its own and must not call back into the cache.
+type EvictionPolicy interface {
+	// RecordInsert is called when key is added to the cache.
+	RecordInsert(key string)
+	// RecordAccess is called when a Get finds key.
+	RecordAccess(key string)
+	// RecordRemove is called when key leaves the cache other than by
+	// Evict. Keys the policy does not track must be ignored.
+	RecordRemove(key string)
+	// Evict returns the key to evict and stops tracking it. It is only
+	// called while the policy tracks at least one key.
+	Evict() string
+}
+
+// AgingPolicy is an EvictionPolicy that counts accesses, and has its
+// counts aged along with the cache's own when SetAccessCountAging is used.
+type AgingPolicy interface {
+	EvictionPolicy
+	// Age halves every access count shift times.
+	Age(shift uint64)
+}
+
+// UpdatePolicy is an EvictionPolicy that is also told when the value of a
+// cached key is replaced.
+type UpdatePolicy interface {
+	EvictionPolicy
+	// RecordUpdate is called when a Set replaces the value of key.
+	RecordUpdate(key string)
+}
+
+// SetEvictionPolicy makes the cache evict the entries chosen by policy.
+// The entries already cached are recorded as inserted, least recently
+// used first. A nil policy restores eviction of the least recently used
+// entry.
+func (c *lru) SetEvictionPolicy(policy EvictionPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = policy
+	if policy == nil {
+		return
+	}
+	c.policyEpoch = c.epoch()
+	c.settleAll()
+	for e := c.list.Back(); e != nil; e = e.Prev() {
+		policy.RecordInsert(e.Value.(*cacheItem).key)
+	}
+}
+
+// untrack tells the eviction policy that key left the cache. The caller
+// must hold c.mu.
+func (c *lru) untrack(key string) {
+	if c.policy != nil {
+		c.policy.RecordRemove(key)
+	}
+}
+
+// agePolicy ages the access counts of the eviction policy, if it is an
+// AgingPolicy, for the aging intervals elapsed since they were last aged.
+// The caller must hold c.mu.
+func (c *lru) agePolicy() {
+	p, ok := c.policy.(AgingPolicy)
+	if !ok {
+		return
+	}
+	if epoch := c.epoch(); epoch > c.policyEpoch {
+		p.Age(epoch - c.policyEpoch)
+		c.policyEpoch = epoch
+	}
+}
+
+// victim returns the element to evict next. The caller must hold c.mu.
+func (c *lru) victim() *list.Element {
+	if c.policy != nil {
+		c.agePolicy()
+		if elem, ok := c.data[c.policy.Evict()]; ok {
+			return elem
+		}
+	}
+	// The back item may have been read since it was last moved.
+	var last *list.Element
+	for last != c.list.Back() {
+		last = c.list.Back()
+		c.settle(last)
+	}
+	c.untrack(last.Value.(*cacheItem).key)
+	return last
+}
+
+// FIFOPolicy evicts the entry that was inserted first, regardless of how
+// it was accessed since.
+type FIFOPolicy struct {
+	order list.List
+	elems map[string]*list.Element
+}
+
+// NewFIFOPolicy creates an empty FIFOPolicy.
+func NewFIFOPolicy() *FIFOPolicy {
+	return &FIFOPolicy{elems: make(map[string]*list.Element)}
+}
+
+func (p *FIFOPolicy) RecordInsert(key string) {
+	p.RecordRemove(key)
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *FIFOPolicy) RecordAccess(key string) {}
+
+func (p *FIFOPolicy) RecordRemove(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.order.Remove(elem)
+		delete(p.elems, key)
+	}
+}
+
+func (p *FIFOPolicy) Evict() string {
+	key := p.order.Remove(p.order.Back()).(string)
+	delete(p.elems, key)
+	return key
+}
+
+// WriteOrderPolicy evicts the entry that was set longest ago, whether it
+// was inserted or updated then. Like FIFOPolicy, it ignores accesses.
+type WriteOrderPolicy struct {
+	FIFOPolicy
+}
+
+// NewWriteOrderPolicy creates an empty WriteOrderPolicy.
+func NewWriteOrderPolicy() *WriteOrderPolicy {
+	return &WriteOrderPolicy{FIFOPolicy{elems: make(map[string]*list.Element)}}
+}
+
+func (p *WriteOrderPolicy) RecordUpdate(key string) {
+	p.RecordInsert(key)
+}
+
+// LFUPolicy evicts the entry with the fewest uses, counting its insertion
+// and every access since. Ties go to the entry that was inserted or
+// accessed longest ago. It is an AgingPolicy, so SetAccessCountAging
+// lets entries that were hot long ago be evicted.
+type LFUPolicy struct {
+	entries lfuHeap
+	index   map[string]*lfuEntry
+	tick    uint64
+}
+
+type lfuEntry struct {
+	key   string
+	count uint64
+	seq   uint64
+	pos   int
+}
+
+// lfuHeap orders entries from least to most frequently accessed.
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.pos = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// NewLFUPolicy creates an empty LFUPolicy.
+func NewLFUPolicy() *LFUPolicy {
+	return &LFUPolicy{index: make(map[string]*lfuEntry)}
+}
+
+func (p *LFUPolicy) RecordInsert(key string) {
+	p.RecordRemove(key)
+	p.tick++
+	e := &lfuEntry{key: key, count: 1, seq: p.tick}
+	p.index[key] = e
+	heap.Push(&p.entries, e)
+}
+
+func (p *LFUPolicy) RecordAccess(key string) {
+	if e, ok := p.index[key]; ok {
+		p.tick++
+		e.count++
+		e.seq = p.tick
+		heap.Fix(&p.entries, e.pos)
+	}
+}
+
+func (p *LFUPolicy) RecordRemove(key string) {
+	if e, ok := p.index[key]; ok {
+		heap.Remove(&p.entries, e.pos)
+		delete(p.index, key)
+	}
+}
+
+func (p *LFUPolicy) Age(shift uint64) {
+	for _, e := range p.entries {
+		if shift < 64 {
+			e.count >>= shift
+		} else {
+			e.count = 0
+		}
+	}
+	heap.Init(&p.entries)
+}
+
+func (p *LFUPolicy) Evict() string {
+	e := heap.Pop(&p.entries).(*lfuEntry)
+	delete(p.index, e.key)
+	return e.key
+}
+
+// LRUKPolicy evicts the entry whose Kth most recent use lies furthest in
+// the past, counting its insertion and every access since as uses. An
+// entry used fewer than K times goes before any other, the least recently
+// used of them first, so that a key read once cannot push out one that is
+// read again and again. A key's uses are forgotten once it leaves the
+// cache.
+type LRUKPolicy struct {
+	k       int
+	entries lruKHeap
+	index   map[string]*lruKEntry
+	tick    uint64
+}
+
+type lruKEntry struct {
+	key string
+	// uses holds the ticks of the last k uses, oldest first.
+	uses []uint64
+	pos  int
+}
+
+// lruKHeap orders entries from the first to the last to evict.
+type lruKHeap struct {
+	k       int
+	entries []*lruKEntry
+}
+
+func (h lruKHeap) Len() int { return len(h.entries) }
+
+func (h lruKHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if full := len(a.uses) >= h.k; full != (len(b.uses) >= h.k) {
+		return !full
+	} else if full {
+		return a.uses[0] < b.uses[0]
+	}
+	return a.uses[len(a.uses)-1] < b.uses[len(b.uses)-1]
+}
+
+func (h lruKHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].pos = i
+	h.entries[j].pos = j
+}
+
+func (h *lruKHeap) Push(x interface{}) {
+	e := x.(*lruKEntry)
+	e.pos = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *lruKHeap) Pop() interface{} {
+	old := h.entries
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	h.entries = old[:len(old)-1]
+	return e
+}
+
+// NewLRUKPolicy creates an empty LRUKPolicy remembering the last k uses
+// of every entry. k < 2 makes it evict like the default policy, the least
+// recently used entry first; 2 gives the classic LRU-2.
+func NewLRUKPolicy(k int) *LRUKPolicy {
+	if k < 1 {
+		k = 1
+	}
+	return &LRUKPolicy{k: k, entries: lruKHeap{k: k}, index: make(map[string]*lruKEntry)}
+}
+
+func (p *LRUKPolicy) RecordInsert(key string) {
+	p.RecordRemove(key)
+	p.tick++
+	e := &lruKEntry{key: key, uses: make([]uint64, 1, p.k)}
+	e.uses[0] = p.tick
+	p.index[key] = e
+	heap.Push(&p.entries, e)
+}
+
+func (p *LRUKPolicy) RecordAccess(key string) {
+	if e, ok := p.index[key]; ok {
+		p.tick++
+		if len(e.uses) == p.k {
+			e.uses = append(e.uses[:0], e.uses[1:]...)
+		}
+		e.uses = append(e.uses, p.tick)
+		heap.Fix(&p.entries, e.pos)
+	}
+}
+
+func (p *LRUKPolicy) RecordRemove(key string) {
+	if e, ok := p.index[key]; ok {
+		heap.Remove(&p.entries, e.pos)
+		delete(p.index, key)
+	}
+}
+
+func (p *LRUKPolicy) Evict() string {
+	e := heap.Pop(&p.entries).(*lruKEntry)
+	delete(p.index, e.key)
+	return e.key
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLFUPolicyKeepsFrequentKeys(t *testing.T) {
+	caches := []CacheInterface{NewSimple(3), New(3, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.SetEvictionPolicy(NewLFUPolicy())
+		case *Cache:
+			c.SetEvictionPolicy(NewLFUPolicy())
+		}
+		c.Set("hot", "1")
+		for i := 0; i < 5; i++ {
+			c.Get("hot")
+		}
+		c.Set("warm", "2")
+		c.Get("warm")
+		c.Get("warm")
+		c.Set("cold", "3")
+
+		// LRU would drop hot, the least recently used.
+		c.Set("key4", "4")
+		if v := c.Get("cold"); v != nil {
+			t.Errorf("cold should be evicted. Got %v", v)
+		}
+		expectCachedValueEquals(t, c, "hot", "1")
+		expectCachedValueEquals(t, c, "warm", "2")
+
+		// An entry that was never read goes next.
+		c.Set("key5", "5")
+		if v := c.Get("key4"); v != nil {
+			t.Errorf("key4 should be evicted. Got %v", v)
+		}
+	}
+}
+
+func TestSimpleCacheWithWriteOrder(t *testing.T) {
+	c := NewSimpleWithOrder(2, false)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Get("key1")
+	c.Set("key3", "3")
+	if v := c.Get("key1"); v != nil {
+		t.Errorf("reading key1 should not save it from eviction. Got %v", v)
+	}
+
+	// Updating a key does.
+	c.Set("key2", "22")
+	c.Set("key4", "4")
+	if v := c.Get("key3"); v != nil {
+		t.Errorf("key3 was written longest ago and should be evicted. Got %v", v)
+	}
+	expectCachedValueEquals(t, c, "key2", "22")
+	expectCachedValueEquals(t, c, "key4", "4")
+
+	lru := NewSimpleWithOrder(2, true)
+	lru.Set("key1", "1")
+	lru.Set("key2", "2")
+	lru.Get("key1")
+	lru.Set("key3", "3")
+	expectCachedValueEquals(t, lru, "key1", "1")
+}
+
+func TestLFUPolicyAgesAccessCounts(t *testing.T) {
+	caches := []CacheInterface{NewSimple(2), New(2, -1, 0*time.Second, newMemFlusher())}
+	for _, c := range caches {
+		clk := newFakeClock()
+		switch c := c.(type) {
+		case *SimpleCache:
+			c.clock = clk
+			c.SetEvictionPolicy(NewLFUPolicy())
+			c.SetAccessCountAging(time.Minute)
+		case *Cache:
+			c.clock = clk
+			c.SetEvictionPolicy(NewLFUPolicy())
+			c.SetAccessCountAging(time.Minute)
+		}
+		c.Set("old", "1")
+		for i := 0; i < 8; i++ {
+			c.Get("old")
+		}
+		clk.Advance(5 * time.Minute)
+		c.Set("new", "2")
+		c.Get("new")
+		c.Get("new")
+
+		// Without aging, old would outrank new.
+		c.Set("key3", "3")
+		if v := c.Get("old"); v != nil {
+			t.Errorf("old should be evicted once its count aged. Got %v", v)
+		}
+		expectCachedValueEquals(t, c, "new", "2")
+	}
+}
+
+func TestNewWithPolicy(t *testing.T) {
+	c := NewWithPolicy(2, NewFIFOPolicy())
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	c.Get("key1")
+	c.Set("key3", "3")
+	if v := c.Get("key1"); v != nil {
+		t.Errorf("key1 was inserted first and should be evicted. Got %v", v)
+	}
+	expectCachedValueEquals(t, c, "key2", "2")
+	expectCachedValueEquals(t, c, "key3", "3")
+}
+
+func TestFIFOPolicyIgnoresAccesses(t *testing.T) {
+	c := NewSimple(2)
+	c.Set("key1", "1")
+	c.SetEvictionPolicy(NewFIFOPolicy())
+	c.Set("key2", "2")
+	c.Get("key1")
+	c.Set("key3", "3")
+	if v := c.Get("key1"); v != nil {
+		t.Errorf("key1 was inserted first and should be evicted. Got %v", v)
+	}
+
+	// Deleted keys are forgotten by the policy.
+	c.Delete("key2")
+	c.Set("key4", "4")
+	c.Set("key5", "5")
+	if c.Len() != 2 {
+		t.Errorf("cache should hold 2 entries. Got %v", c.Len())
+	}
+	expectCachedValueEquals(t, c, "key4", "4")
+	expectCachedValueEquals(t, c, "key5", "5")
+}
+
+func TestLFUPolicyRemove(t *testing.T) {
+	p := NewLFUPolicy()
+	for _, k := range []string{"key1", "key2", "key3"} {
+		p.RecordInsert(k)
+	}
+	p.RecordAccess("key1")
+	p.RecordRemove("key2")
+	p.RecordRemove("notexist")
+	if k := p.Evict(); k != "key3" {
+		t.Errorf("should evict key3. Got %v", k)
+	}
+	if k := p.Evict(); k != "key1" {
+		t.Errorf("should evict key1. Got %v", k)
+	}
+}
+
+func TestLRUKPolicyKeepsReusedKeys(t *testing.T) {
+	for _, test := range []struct {
+		policy  EvictionPolicy
+		evicted string
+	}{{nil, "reused"}, {NewLRUKPolicy(2), "once"}} {
+		c := NewSimple(2)
+		if test.policy != nil {
+			c.SetEvictionPolicy(test.policy)
+		}
+		c.Set("reused", "1")
+		c.Get("reused")
+		c.Set("once", "2")
+		c.Set("key3", "3")
+		if c.Contains(test.evicted) {
+			t.Errorf("%v should be evicted with policy %T", test.evicted, test.policy)
+		}
+		if c.Len() != 2 {
+			t.Errorf("cache should hold 2 entries. Got %v", c.Len())
+		}
+	}
+}
+
+func TestLRUKPolicyEvictsByKthUse(t *testing.T) {
+	p := NewLRUKPolicy(3)
+	for _, k := range []string{"key1", "key2", "key3"} {
+		p.RecordInsert(k)
+	}
+	for i := 0; i < 2; i++ {
+		p.RecordAccess("key1")
+		p.RecordAccess("key2")
+	}
+	p.RecordAccess("key1")
+	p.RecordAccess("key3")
+	// key3 was used twice only, and key2's third to last use is older
+	// than key1's.
+	for _, expected := range []string{"key3", "key2", "key1"} {
+		if k := p.Evict(); k != expected {
+			t.Errorf("should evict %v. Got %v", expected, k)
+		}
+	}
+}
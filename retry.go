@@ -0,0 +1,125 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// maxRetryDelay bounds the backoff of a RetryingFlusher, unless its
+// baseDelay is longer.
+const maxRetryDelay = time.Minute
+
+// RetryingFlusher retries failed writes of another flusher with
+// exponential backoff. It only returns an error once every attempt has
+// failed, and then returns the last one. Written to with a context, as
+// by FlushContext or the periodic flush, it stops backing off once the
+// context is done and returns the context's error.
+type RetryingFlusher struct {
+	flusher     FlusherWithError
+	maxAttempts int
+	baseDelay   time.Duration
+	sleep       func(ctx context.Context, d time.Duration) error
+}
+
+var (
+	_ FlusherWithError   = &RetryingFlusher{}
+	_ FlusherWithContext = &RetryingFlusher{}
+)
+
+// NewRetryingFlusher makes at most maxAttempts attempts at each write to
+// flusher. The n-th retry waits for a random duration between half and
+// all of baseDelay * 2^(n-1), up to a minute or baseDelay if longer. If
+// flusher implements FlusherWithContext, the context of a write is passed
+// on to it.
+func NewRetryingFlusher(flusher FlusherWithError, maxAttempts int, baseDelay time.Duration) *RetryingFlusher {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &RetryingFlusher{
+		flusher:     flusher,
+		maxAttempts: maxAttempts,
+		baseDelay:   baseDelay,
+		sleep:       sleepContext,
+	}
+}
+
+// sleepContext waits for d or until ctx is done, and then returns its
+// error.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (f *RetryingFlusher) Add(key string, value interface{}) error {
+	return f.AddContext(context.Background(), key, value)
+}
+
+func (f *RetryingFlusher) Remove(key string) error {
+	return f.RemoveContext(context.Background(), key)
+}
+
+func (f *RetryingFlusher) AddContext(ctx context.Context, key string, value interface{}) error {
+	return f.retry(ctx, func() error {
+		if cf, ok := f.flusher.(FlusherWithContext); ok {
+			return cf.AddContext(ctx, key, value)
+		}
+		return f.flusher.Add(key, value)
+	})
+}
+
+func (f *RetryingFlusher) RemoveContext(ctx context.Context, key string) error {
+	return f.retry(ctx, func() error {
+		if cf, ok := f.flusher.(FlusherWithContext); ok {
+			return cf.RemoveContext(ctx, key)
+		}
+		return f.flusher.Remove(key)
+	})
+}
+
+func (f *RetryingFlusher) retry(ctx context.Context, write func() error) error {
+	maxDelay := maxRetryDelay
+	if f.baseDelay > maxDelay {
+		maxDelay = f.baseDelay
+	}
+	delay := f.baseDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = write(); err == nil || attempt == f.maxAttempts {
+			return err
+		}
+		if delay > 0 {
+			if err := f.sleep(ctx, delay/2+time.Duration(rand.Int63n(int64(delay/2)+1))); err != nil {
+				return err
+			}
+		}
+		if delay > maxDelay/2 {
+			delay = maxDelay
+		} else {
+			delay *= 2
+		}
+	}
+}
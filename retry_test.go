@@ -0,0 +1,139 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakyFlusher fails the first nrFailures writes.
+type flakyFlusher struct {
+	*memFlusher
+	nrFailures int
+	nrAttempts int
+}
+
+func (f *flakyFlusher) attempt() error {
+	f.nrAttempts++
+	if f.nrAttempts <= f.nrFailures {
+		return errors.New("backend unavailable")
+	}
+	return nil
+}
+
+func (f *flakyFlusher) Add(key string, value interface{}) error {
+	if err := f.attempt(); err != nil {
+		return err
+	}
+	f.memFlusher.Add(key, value)
+	return nil
+}
+
+func (f *flakyFlusher) Remove(key string) error {
+	if err := f.attempt(); err != nil {
+		return err
+	}
+	f.memFlusher.Remove(key)
+	return nil
+}
+
+func TestRetryingFlusherSucceedsEventually(t *testing.T) {
+	backend := &flakyFlusher{memFlusher: newMemFlusher(), nrFailures: 3}
+	rf := NewRetryingFlusher(backend, 5, 10*time.Millisecond)
+	var delays []time.Duration
+	rf.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+
+	c := NewWithErrorFlusher(5, -1, 0*time.Second, rf)
+	c.Set("key1", "1")
+	if result := c.FlushWithResult(); len(result.Failed) != 0 {
+		t.Errorf("retries should hide transient failures. Got %v", result.Failed)
+	}
+	if v, _ := backend.threadSafeGet("key1"); v != "1" {
+		t.Errorf("key1 should reach the backend. Got %v", v)
+	}
+	if backend.nrAttempts != 4 {
+		t.Errorf("should take 4 attempts. Took %v", backend.nrAttempts)
+	}
+
+	if len(delays) != 3 {
+		t.Fatalf("should back off 3 times. Got %v", delays)
+	}
+	for i, d := range delays {
+		max := 10 * time.Millisecond << uint(i)
+		if d < max/2 || d > max {
+			t.Errorf("backoff %v should be in [%v, %v]. Got %v", i, max/2, max, d)
+		}
+	}
+}
+
+func TestRetryingFlusherGivesUp(t *testing.T) {
+	backend := &flakyFlusher{memFlusher: newMemFlusher(), nrFailures: 10}
+	rf := NewRetryingFlusher(backend, 3, 0)
+
+	if err := rf.Remove("key1"); err == nil {
+		t.Errorf("should return the error once attempts run out")
+	}
+	if backend.nrAttempts != 3 {
+		t.Errorf("should make 3 attempts. Made %v", backend.nrAttempts)
+	}
+}
+
+func TestRetryingFlusherCapsDelay(t *testing.T) {
+	backend := &flakyFlusher{memFlusher: newMemFlusher(), nrFailures: 100}
+	rf := NewRetryingFlusher(backend, 100, time.Second)
+	var longest time.Duration
+	rf.sleep = func(ctx context.Context, d time.Duration) error {
+		if d > longest {
+			longest = d
+		}
+		return nil
+	}
+	rf.Add("key1", "1")
+	if longest > maxRetryDelay || longest < maxRetryDelay/2 {
+		t.Errorf("backoff should grow up to %v. Got %v", maxRetryDelay, longest)
+	}
+}
+
+func TestRetryingFlusherStopsOnCancel(t *testing.T) {
+	backend := &flakyFlusher{memFlusher: newMemFlusher(), nrFailures: 10}
+	rf := NewRetryingFlusher(backend, 10, time.Hour)
+	c := NewWithErrorFlusher(5, -1, 0*time.Second, rf)
+	c.Set("key1", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.FlushContext(ctx) }()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("the flush should stop with the context. Got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("backing off should stop once the context is done")
+	}
+	if n := c.DirtyLen(); n != 1 {
+		t.Errorf("key1 should stay dirty. Got %v dirty", n)
+	}
+}
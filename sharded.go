@@ -0,0 +1,106 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"fmt"
+	"hash/maphash"
+	"strings"
+)
+
+// ShardedCache spreads its entries over several SimpleCaches, each with
+// its own lock, so that operations on different keys rarely contend.
+// Recency and capacity are tracked per shard: an entry is evicted when
+// its own shard is full, even if other shards have room.
+type ShardedCache struct {
+	hash   func(key string) uint64
+	shards []*SimpleCache
+}
+
+// NewSharded creates a ShardedCache of n shards sharing capacity between
+// them. n < 1 is treated as 1. capacity < 0 means as for NewSimple. Keys
+// are spread over the shards by hash/maphash, with a random seed.
+func NewSharded(capacity, n int) *ShardedCache {
+	seed := maphash.MakeSeed()
+	return NewShardedWithHasher(capacity, n, func(key string) uint64 {
+		return maphash.String(seed, key)
+	})
+}
+
+// NewShardedWithHasher creates a ShardedCache like NewSharded that puts a
+// key in shard hash(key) % n. hash must spread keys evenly for the shards
+// to fill evenly, and must be safe for concurrent use.
+func NewShardedWithHasher(capacity, n int, hash func(key string) uint64) *ShardedCache {
+	if n < 1 {
+		n = 1
+	}
+	c := &ShardedCache{hash: hash, shards: make([]*SimpleCache, n)}
+	for i := range c.shards {
+		size := capacity
+		if capacity >= 0 {
+			size = capacity / n
+			if i < capacity%n {
+				size++
+			}
+		}
+		c.shards[i] = NewSimple(size)
+	}
+	return c
+}
+
+func (c *ShardedCache) shard(key string) *SimpleCache {
+	return c.shards[c.hash(key)%uint64(len(c.shards))]
+}
+
+// Len returns the number of entries in all shards.
+func (c *ShardedCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+func (c *ShardedCache) Set(key string, value interface{}) {
+	c.shard(key).Set(key, value)
+}
+
+func (c *ShardedCache) Get(key string) interface{} {
+	return c.shard(key).Get(key)
+}
+
+func (c *ShardedCache) Delete(key string) interface{} {
+	return c.shard(key).Delete(key)
+}
+
+// Flush does nothing: a ShardedCache has no backing store.
+func (c *ShardedCache) Flush() {}
+
+// String describes every shard of the cache for debugging, in order.
+func (c *ShardedCache) String() string {
+	var b strings.Builder
+	for i, s := range c.shards {
+		fmt.Fprintf(&b, "=============shard %v=============\n", i)
+		b.WriteString(s.String())
+	}
+	return b.String()
+}
+
+func (c *ShardedCache) debug() {
+	fmt.Print(c.String())
+}
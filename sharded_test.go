@@ -0,0 +1,150 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestShardedCache(t *testing.T) {
+	// Room for every key even if they hash unevenly.
+	var c CacheInterface = NewSharded(800, 8)
+	for i := 0; i < 50; i++ {
+		c.Set(strconv.Itoa(i), strconv.Itoa(i))
+	}
+	if c.Len() != 50 {
+		t.Errorf("cache should hold 50 entries. Got %v", c.Len())
+	}
+	for i := 0; i < 50; i++ {
+		expectCachedValueEquals(t, c, strconv.Itoa(i), strconv.Itoa(i))
+	}
+	for i := 0; i < 50; i += 2 {
+		if v := c.Delete(strconv.Itoa(i)); v != strconv.Itoa(i) {
+			t.Errorf("should delete %v on key %v. Got %v", i, i, v)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		v := c.Get(strconv.Itoa(i))
+		if i%2 == 0 && v != nil {
+			t.Errorf("key %v should be deleted. Got %v", i, v)
+		} else if i%2 == 1 && v != strconv.Itoa(i) {
+			t.Errorf("should be %v on key %v. Got %v", i, i, v)
+		}
+	}
+	if c.Len() != 25 {
+		t.Errorf("cache should hold 25 entries. Got %v", c.Len())
+	}
+}
+
+func TestShardedCacheSplitsCapacity(t *testing.T) {
+	c := NewSharded(10, 4)
+	total := 0
+	for _, s := range c.shards {
+		total += s.capacity
+	}
+	if total != 10 {
+		t.Errorf("shards should share a capacity of 10. Got %v", total)
+	}
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	if c.Len() != 10 {
+		t.Errorf("cache should hold 10 entries. Got %v", c.Len())
+	}
+}
+
+func TestShardedCacheWithHasher(t *testing.T) {
+	byNumber := func(key string) uint64 {
+		n, _ := strconv.Atoi(key)
+		return uint64(n)
+	}
+	c := NewShardedWithHasher(-1, 4, byNumber)
+	for i := 0; i < 20; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	for i := 0; i < 20; i++ {
+		if !c.shards[i%4].Contains(strconv.Itoa(i)) {
+			t.Errorf("key %v should be in shard %v", i, i%4)
+		}
+	}
+
+	spread := NewShardedWithHasher(-1, 4, func(key string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		return h.Sum64()
+	})
+	for i := 0; i < 1000; i++ {
+		spread.Set("key"+strconv.Itoa(i), i)
+	}
+	for i, s := range spread.shards {
+		if n := s.Len(); n < 150 || n > 350 {
+			t.Errorf("shard %v should hold about 250 of 1000 keys. Got %v", i, n)
+		}
+	}
+}
+
+func benchmarkConcurrentAccess(b *testing.B, c CacheInterface) {
+	keys := benchmarkKeys(4096)
+	for _, k := range keys[:1024] {
+		c.Set(k, k)
+	}
+	var wg sync.WaitGroup
+	const goroutines = 16
+	b.ResetTimer()
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < b.N; i += goroutines {
+				k := keys[i%len(keys)]
+				if i%4 == 0 {
+					c.Set(k, k)
+				} else {
+					c.Get(k)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func BenchmarkSimpleCacheConcurrent(b *testing.B) {
+	benchmarkConcurrentAccess(b, NewSimple(2048))
+}
+
+func TestShardedCacheString(t *testing.T) {
+	c := NewShardedWithHasher(-1, 2, func(key string) uint64 { return uint64(len(key)) })
+	c.Set("a", "1")
+	c.Set("bb", "2")
+	s := c.String()
+	shard0, shard1 := strings.Index(s, "shard 0"), strings.Index(s, "shard 1")
+	if shard0 < 0 || shard1 < shard0 {
+		t.Fatalf("should describe the shards in order. Got %q", s)
+	}
+	if !strings.Contains(s[shard0:shard1], "bb: 2") || !strings.Contains(s[shard1:], "a: 1") {
+		t.Errorf("should list the entries of each shard. Got %q", s)
+	}
+}
+
+func BenchmarkShardedCacheConcurrent(b *testing.B) {
+	benchmarkConcurrentAccess(b, NewSharded(2048, 16))
+}
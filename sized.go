@@ -0,0 +1,41 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+// SizedCache is a SimpleCache bounded by the total size of its values in
+// bytes rather than by their number.
+type SizedCache struct {
+	*SimpleCache
+}
+
+// NewSized creates a SizedCache holding values of at most maxBytes in
+// total, as measured by sizeOf. The least recently used entries are
+// evicted to make room for new ones. A value larger than maxBytes on its
+// own is not stored, and does not evict anything else.
+func NewSized(maxBytes int64, sizeOf func(value interface{}) int64) *SizedCache {
+	c := &SizedCache{SimpleCache: NewSimple(-1)}
+	c.SetMaxSize(int(maxBytes), func(value interface{}) int {
+		return int(sizeOf(value))
+	})
+	return c
+}
+
+// Bytes returns the total size of the values in the cache.
+func (c *SizedCache) Bytes() int64 {
+	return int64(c.Size())
+}
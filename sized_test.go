@@ -0,0 +1,58 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import "testing"
+
+func TestSizedCache(t *testing.T) {
+	c := NewSized(100, func(value interface{}) int64 { return int64(len(value.([]byte))) })
+	c.Set("small1", make([]byte, 10))
+	c.Set("small2", make([]byte, 20))
+	c.Set("medium", make([]byte, 50))
+	if n := c.Bytes(); n != 80 {
+		t.Errorf("cache should hold 80 bytes. Got %v", n)
+	}
+	c.Get("small1")
+
+	// 110 bytes do not fit, so the least recently used entry goes.
+	c.Set("small3", make([]byte, 30))
+	if v := c.Get("small2"); v != nil {
+		t.Errorf("small2 should be evicted")
+	}
+	if n := c.Bytes(); n != 90 || c.Len() != 3 {
+		t.Errorf("cache should hold 3 entries of 90 bytes. Got %v of %v", c.Len(), n)
+	}
+
+	// A value larger than the whole cache is rejected on its own.
+	c.Set("huge", make([]byte, 200))
+	if v := c.Get("huge"); v != nil {
+		t.Errorf("huge should not be stored")
+	}
+	if n := c.Bytes(); n != 90 || c.Len() != 3 {
+		t.Errorf("other entries should stay. Got %v entries of %v bytes", c.Len(), n)
+	}
+
+	// Replacing a value with a larger one rejects the key too.
+	c.Set("small1", make([]byte, 150))
+	if v := c.Get("small1"); v != nil {
+		t.Errorf("small1 should be dropped")
+	}
+	if n := c.Bytes(); n != 80 {
+		t.Errorf("cache should hold 80 bytes. Got %v", n)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TieredCache puts a small, fast cache in front of a larger one. Reads
+// try the first tier, then the second, and copy what they find there
+// into the first; writes and deletes go to both.
+type TieredCache struct {
+	l1, l2 CacheInterface
+}
+
+var _ CacheInterface = &TieredCache{}
+
+// NewTiered creates a TieredCache reading from l1 before l2.
+func NewTiered(l1, l2 CacheInterface) *TieredCache {
+	return &TieredCache{l1: l1, l2: l2}
+}
+
+// Len returns the number of entries in both tiers added together, so an
+// entry held by both counts twice.
+func (c *TieredCache) Len() int {
+	return c.l1.Len() + c.l2.Len()
+}
+
+func (c *TieredCache) Set(key string, value interface{}) {
+	c.l2.Set(key, value)
+	c.l1.Set(key, value)
+}
+
+// Get returns the value stored under key in l1, or else in l2, and then
+// also stores it in l1.
+func (c *TieredCache) Get(key string) interface{} {
+	if value := c.l1.Get(key); value != nil {
+		return value
+	}
+	value := c.l2.Get(key)
+	if value != nil {
+		c.l1.Set(key, value)
+	}
+	return value
+}
+
+// Delete removes key from both tiers and returns the value l1 held, or
+// else the one l2 held.
+func (c *TieredCache) Delete(key string) interface{} {
+	value := c.l1.Delete(key)
+	if v := c.l2.Delete(key); value == nil {
+		value = v
+	}
+	return value
+}
+
+// Flush flushes l1, then l2.
+func (c *TieredCache) Flush() {
+	c.l1.Flush()
+	c.l2.Flush()
+}
+
+// String describes both levels of the cache for debugging, l1 first.
+func (c *TieredCache) String() string {
+	var b strings.Builder
+	b.WriteString("=============l1=============\n")
+	fmt.Fprint(&b, c.l1)
+	b.WriteString("=============l2=============\n")
+	fmt.Fprint(&b, c.l2)
+	return b.String()
+}
+
+func (c *TieredCache) debug() {
+	fmt.Print(c.String())
+}
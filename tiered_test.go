@@ -0,0 +1,70 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTieredCachePromotes(t *testing.T) {
+	f := newMemFlusher()
+	l1, l2 := NewSimple(1), New(10, -1, 0*time.Second, f)
+	c := NewTiered(l1, l2)
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	if v := l1.Get("key1"); v != nil {
+		t.Errorf("key1 should be evicted from l1. Got %v", v)
+	}
+
+	expectCachedValueEquals(t, c, "key1", "1")
+	if v, ok := l1.Peek("key1"); !ok || v != "1" {
+		t.Errorf("an l2 hit should be promoted into l1. Got %v", v)
+	}
+	hits := l2.Stats().Hits
+	expectCachedValueEquals(t, c, "key1", "1")
+	if n := l2.Stats().Hits; n != hits {
+		t.Errorf("the second Get should be served by l1. Got %v l2 hits", n-hits)
+	}
+
+	if v := c.Delete("key1"); v != "1" {
+		t.Errorf("should delete 1 on key1. Got %v", v)
+	}
+	if v := c.Get("key1"); v != nil {
+		t.Errorf("key1 should be deleted from both tiers. Got %v", v)
+	}
+	c.Flush()
+	if _, ok := f.threadSafeGet("key1"); ok {
+		t.Errorf("the removal should reach the flusher of l2")
+	}
+}
+
+func TestTieredCacheString(t *testing.T) {
+	c := NewTiered(NewSimple(1), New(10, -1, 0*time.Second, newMemFlusher()))
+	c.Set("key1", "1")
+	c.Set("key2", "2")
+	s := c.String()
+	l1, l2 := strings.Index(s, "=l1="), strings.Index(s, "=l2=")
+	if l1 < 0 || l2 < l1 {
+		t.Fatalf("should describe l1, then l2. Got %q", s)
+	}
+	if !strings.Contains(s[l1:l2], "key2: 2") || !strings.Contains(s[l2:], "key1: 1; modified: true") {
+		t.Errorf("should list the entries of each level. Got %q", s)
+	}
+}
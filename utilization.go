@@ -0,0 +1,96 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import "time"
+
+// utilizationSampler keeps the last few utilization samples of a cache in
+// a ring buffer.
+type utilizationSampler struct {
+	interval time.Duration
+	samples  []float64
+	next     int
+	full     bool
+	timer    timer
+	stopped  bool
+}
+
+func (s *utilizationSampler) add(sample float64) {
+	s.samples[s.next] = sample
+	s.next++
+	if s.next == len(s.samples) {
+		s.next = 0
+		s.full = true
+	}
+}
+
+func (s *utilizationSampler) stop() {
+	s.stopped = true
+	s.timer.Stop()
+}
+
+// SampleUtilization makes the cache record how full it is, as its number
+// of entries over its capacity, once every interval. The last n samples
+// are kept and returned by UtilizationSamples. A cache without a bound on
+// its size always reports 0. Sampling runs on a timer rather than a
+// goroutine of its own, and stops on Close, after which SampleUtilization
+// does not start it again. An interval or n that is not positive stops the
+// sampling and drops the samples.
+func (c *lru) SampleUtilization(interval time.Duration, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sampler != nil {
+		c.sampler.stop()
+		c.sampler = nil
+	}
+	if interval <= 0 || n <= 0 || c.closed {
+		return
+	}
+	s := &utilizationSampler{interval: interval, samples: make([]float64, n)}
+	c.sampler = s
+	s.timer = c.time().AfterFunc(interval, func() { c.sampleUtilization(s) })
+}
+
+func (c *lru) sampleUtilization(s *utilizationSampler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.stopped || c.closed {
+		return
+	}
+	var utilization float64
+	if c.capacity > 0 {
+		utilization = float64(len(c.data)) / float64(c.capacity)
+	}
+	s.add(utilization)
+	s.timer = c.time().AfterFunc(s.interval, func() { c.sampleUtilization(s) })
+}
+
+// UtilizationSamples returns the samples recorded since SampleUtilization
+// was called, oldest first.
+func (c *lru) UtilizationSamples() []float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.sampler
+	if s == nil {
+		return nil
+	}
+	if !s.full {
+		return append([]float64(nil), s.samples[:s.next]...)
+	}
+	return append(append([]float64(nil), s.samples[s.next:]...), s.samples[:s.next]...)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUtilizationSamples(t *testing.T) {
+	clk := newFakeClock()
+	c := NewSimple(4)
+	c.clock = clk
+	c.SampleUtilization(time.Minute, 3)
+
+	clk.Advance(time.Minute)
+	c.Set("key1", "1")
+	clk.Advance(time.Minute)
+	c.Set("key2", "2")
+	c.Set("key3", "3")
+	clk.Advance(time.Minute)
+	if s := fmt.Sprint(c.UtilizationSamples()); s != "[0 0.25 0.75]" {
+		t.Errorf("samples should be [0 0.25 0.75]. Got %v", s)
+	}
+
+	c.Set("key4", "4")
+	c.Set("key5", "5")
+	clk.Advance(time.Minute)
+	if s := fmt.Sprint(c.UtilizationSamples()); s != "[0.25 0.75 1]" {
+		t.Errorf("oldest sample should be dropped. Got %v", s)
+	}
+
+	c.Close()
+	clk.Advance(time.Minute)
+	if n := len(c.UtilizationSamples()); n != 3 {
+		t.Errorf("sampling should stop on Close. Got %v samples", n)
+	}
+}
+
+func TestNoUtilizationSamplesAfterClose(t *testing.T) {
+	clk := newFakeClock()
+	c := NewSimple(4)
+	c.clock = clk
+	c.SampleUtilization(time.Minute, 10)
+	clk.Advance(time.Minute)
+	c.Close()
+	clk.Advance(5 * time.Minute)
+	if n := len(c.UtilizationSamples()); n != 1 {
+		t.Errorf("no sample should arrive after Close. Got %v samples", n)
+	}
+
+	c.SampleUtilization(time.Minute, 10)
+	clk.Advance(5 * time.Minute)
+	if s := c.UtilizationSamples(); len(s) != 0 {
+		t.Errorf("sampling should not restart after Close. Got %v", s)
+	}
+}
+
+func TestSampleUtilizationRejectsNonPositiveArguments(t *testing.T) {
+	clk := newFakeClock()
+	c := NewSimple(4)
+	c.clock = clk
+	for _, args := range []struct {
+		interval time.Duration
+		n        int
+	}{{time.Minute, 0}, {time.Minute, -1}, {0, 3}, {-time.Minute, 3}} {
+		c.SampleUtilization(args.interval, args.n)
+		clk.Advance(time.Minute)
+		if s := c.UtilizationSamples(); s != nil {
+			t.Errorf("SampleUtilization(%v, %v) should not sample. Got %v", args.interval, args.n, s)
+		}
+	}
+
+	// They also stop sampling that was started before.
+	c.SampleUtilization(time.Minute, 3)
+	clk.Advance(time.Minute)
+	c.SampleUtilization(0, 3)
+	clk.Advance(time.Minute)
+	if s := c.UtilizationSamples(); s != nil {
+		t.Errorf("sampling should be stopped. Got %v", s)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import "weak"
+
+// weakValue is stored in place of a value held through a weak pointer.
+type weakValue interface {
+	// strong returns the referenced value, or false once it has been
+	// garbage collected.
+	strong() (interface{}, bool)
+}
+
+type weakRef[T any] struct {
+	p weak.Pointer[T]
+}
+
+func (w weakRef[T]) strong() (interface{}, bool) {
+	if v := w.p.Value(); v != nil {
+		return v, true
+	}
+	return nil, false
+}
+
+// resolve returns the value stored in an item, following weak pointers.
+// It reports false if the referent has been collected.
+func resolve(value interface{}) (interface{}, bool) {
+	if w, ok := value.(weakValue); ok {
+		return w.strong()
+	}
+	return value, true
+}
+
+// SetWeak stores value in c without keeping it alive: once value is no
+// longer referenced outside the cache, the garbage collector may reclaim
+// it, and the entry then becomes a miss. A hit returns the *T.
+func SetWeak[T any](c *SimpleCache, key string, value *T) {
+	c.Set(key, weakRef[T]{p: weak.Make(value)})
+}
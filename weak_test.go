@@ -0,0 +1,49 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cache2
+
+import (
+	"runtime"
+	"testing"
+)
+
+type blob struct {
+	data [1 << 16]byte
+}
+
+func TestWeakValueIsCollected(t *testing.T) {
+	c := NewSimple(5)
+	b := &blob{}
+	b.data[0] = 42
+	SetWeak(c, "key1", b)
+
+	if v, ok := c.Get("key1").(*blob); !ok || v.data[0] != 42 {
+		t.Errorf("key1 should hold the blob while it is referenced")
+	}
+	runtime.KeepAlive(b)
+
+	b = nil
+	runtime.GC()
+	runtime.GC()
+	if v := c.Get("key1"); v != nil {
+		t.Errorf("key1 should be a miss once the blob is collected")
+	}
+	if c.Len() != 0 {
+		t.Errorf("collected entry should be removed. Len is %v", c.Len())
+	}
+}